@@ -3,80 +3,245 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"embed"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
 	"os"
 	"path"
+	"strings"
 	"time"
 
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"golang.org/x/sync/errgroup"
 )
 
 //go:embed *.html
 var BackendFS embed.FS
 
-func (c *ServeBackendCmd) Run(p *ProgramCtx) error {
-	log.SetPrefix(fmt.Sprintf("[c %v %v %s] ", os.Getpid(), mustResolveHostIP(), c.Name))
+func newBackendHandler(opts BackendOptions, faults *faultInjector, health *healthState, stats *statsCollector) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(controlPathPrefix+"faults", faults)
+	mux.Handle(controlPathPrefix+"health", health)
+	mux.Handle(controlPathPrefix+"stats", stats)
+	mux.Handle(opts.HealthPath, health.Handler())
+	mux.Handle(websocketPath, stats.Handler(websocketEchoHandler()))
+
+	content := http.NewServeMux()
+	content.Handle("/", http.FileServer(http.FS(BackendFS)))
+	content.Handle(grpcServicePrefix, grpcEchoHandler())
+	mux.Handle("/", stats.Handler(faults.Handler(delayHandler(opts, content))))
+	return mux
+}
 
-	var t = mustParseTrafficType(string(c.TrafficType))
+// loadBackendTLSConfig loads the shared backend certificate once so
+// that many backends can be served without each of them parsing it.
+// The root CA is loaded too, for backends that verify client
+// certificates.
+func loadBackendTLSConfig(certs CertStore) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certs.DomainFile, certs.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	rootCA, err := os.ReadFile(certs.RootCAFile)
+	if err != nil {
+		return nil, err
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(rootCA) {
+		return nil, fmt.Errorf("no certificates in %s", certs.RootCAFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+	}, nil
+}
+
+// registrar records where backends are listening: the registry of
+// serve-backends for in-process backends, or the metadata server for
+// backend processes.
+type registrar interface {
+	Register(BoundBackend) error
+	Heartbeat(BoundBackend) error
+	Deregister(BoundBackend) error
+}
 
-	listenAddress := c.ListenAddress
+// serveBackend serves backend until ctx is done. Once the backend is
+// listening it is registered with the address it is bound to, sends a
+// heartbeat every opts.Heartbeat and is deregistered on shutdown.
+// tlsConfig is only used by traffic types that terminate TLS at the
+// backend. With opts.ClientAuth, reencrypt backends also require a
+// client certificate from tlsConfig.ClientCAs.
+func serveBackend(ctx context.Context, backend Backend, listenAddress string, opts BackendOptions, tlsConfig *tls.Config, r registrar) error {
 	if listenAddress == "" || listenAddress == "127.0.0.1" || listenAddress == "::1" {
 		listenAddress = "0.0.0.0"
 	}
 
+	if opts.ClientAuth && backend.TrafficType == ReencryptTraffic && tlsConfig != nil {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	if err := validateHealthPath(opts.HealthPath); err != nil {
+		return err
+	}
+
+	faults := &faultInjector{}
+	if err := faults.Set(opts.Faults); err != nil {
+		return err
+	}
+
 	listener, err := net.Listen("tcp", fmt.Sprintf("%v:0", listenAddress))
 	if err != nil {
 		return err
 	}
 
-	certs := certStore(path.Join(p.Globals.OutputDir, "certs"))
-
 	httpServer := &http.Server{
-		Handler:      http.FileServer(http.FS(BackendFS)),
-		Addr:         fmt.Sprintf("%v:%v", listenAddress, p.Port),
+		Handler:      newBackendHandler(opts, faults, &healthState{}, &statsCollector{}),
 		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
+		WriteTimeout: opts.WriteTimeout,
+		TLSConfig:    tlsConfig,
 	}
 
-	g, gCtx := errgroup.WithContext(p.Context)
+	switch {
+	case backend.TrafficType == GRPCTraffic, opts.HTTP2 && tlsConfig == nil:
+		httpServer.Handler = h2c.NewHandler(httpServer.Handler, &http2.Server{})
+	case opts.HTTP1Only:
+		// A non-nil, empty TLSNextProto stops ServeTLS from
+		// offering h2 via ALPN.
+		httpServer.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+
+	if listenAddress == "0.0.0.0" {
+		listenAddress = mustResolveHostIP()
+	}
+
+	boundBackend := BoundBackend{
+		Backend:       backend,
+		ListenAddress: listenAddress,
+		Port:          listener.Addr().(*net.TCPAddr).Port,
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	g, gCtx := errgroup.WithContext(ctx)
+	registered := make(chan struct{})
 
 	g.Go(func() error {
-		switch t {
-		case HTTPTraffic, EdgeTraffic:
+		if !backend.TrafficType.BackendTLS() {
 			return httpServer.Serve(listener)
-		default:
-			return httpServer.ServeTLS(listener, certs.DomainFile, certs.TLSKeyFile)
 		}
+		return httpServer.ServeTLS(listener, "", "")
 	})
 
 	g.Go(func() error {
 		<-gCtx.Done()
+		select {
+		case <-registered:
+			// Deregister first so that nothing new is
+			// routed here while in-flight requests drain.
+			if err := r.Deregister(boundBackend); err != nil {
+				log.Printf("failed to deregister: %v\n", err)
+			}
+		default:
+		}
 		httpServer.SetKeepAlivesEnabled(false)
 		shutdownCtx, shutdownRelease := context.WithTimeout(context.Background(), httpServer.WriteTimeout)
 		defer shutdownRelease()
 		return httpServer.Shutdown(shutdownCtx)
 	})
 
-	if listenAddress == "0.0.0.0" {
-		listenAddress = mustResolveHostIP()
+	if err := r.Register(boundBackend); err != nil {
+		// Shut the server down and wait for it rather than
+		// leaving it serving an unregistered backend.
+		cancel()
+		_ = g.Wait()
+		return err
 	}
 
-	boundBackend := BoundBackend{
-		Backend: Backend{
-			Name:        c.Name,
-			TrafficType: t,
+	close(registered)
+
+	if opts.Heartbeat > 0 {
+		g.Go(func() error {
+			// Spread the heartbeats of backends started
+			// together across the interval.
+			if !sleepContext(gCtx, time.Duration(rand.Int63n(int64(opts.Heartbeat)))) {
+				return nil
+			}
+			ticker := time.NewTicker(opts.Heartbeat)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-gCtx.Done():
+					return nil
+				case <-ticker.C:
+					if err := r.Heartbeat(boundBackend); err != nil {
+						log.Printf("heartbeat failed: %v\n", err)
+					}
+				}
+			}
+		})
+	}
+
+	if err := g.Wait(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+// metadataServer registers backends with the metadata server of a
+// serve-backends at url: the local one for backend processes, or a
+// central one for every backend of a host.
+type metadataServer struct {
+	client *http.Client
+	ctx    context.Context
+	relay  string
+	url    string
+}
+
+func newMetadataServer(ctx context.Context, url string) *metadataServer {
+	// Keep enough idle connections for the concurrent heartbeats
+	// of a relay.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 32
+
+	return &metadataServer{
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: transport,
 		},
-		ListenAddress: listenAddress,
-		Port:          listener.Addr().(*net.TCPAddr).Port,
+		ctx: ctx,
+		url: strings.TrimSuffix(url, "/"),
 	}
+}
+
+// Register POSTs boundBackend to /register, retrying with backoff
+// while the metadata server is unreachable. It gives up only when
+// ctx is done: serve-backends decides how long registration may take
+// and stops backends that miss its deadline.
+func (m *metadataServer) Register(boundBackend BoundBackend) error {
+	return m.post("register", boundBackend, true)
+}
+
+func (m *metadataServer) Heartbeat(boundBackend BoundBackend) error {
+	return m.post("heartbeat", boundBackend, false)
+}
+
+func (m *metadataServer) Deregister(boundBackend BoundBackend) error {
+	return m.post("deregister", boundBackend, false)
+}
 
+func (m *metadataServer) post(endpoint string, boundBackend BoundBackend, retry bool) error {
 	jsonValue, err := json.Marshal(boundBackend)
 	if err != nil {
 		return err
@@ -84,32 +249,38 @@ func (c *ServeBackendCmd) Run(p *ProgramCtx) error {
 
 	var (
 		resp    *http.Response
-		retries = 17
+		postErr error
 	)
 
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-	}
-
-	url := fmt.Sprintf("http://127.0.0.1:%d/register", p.Port)
+	url := fmt.Sprintf("%s/%s", m.url, endpoint)
+	backoff := 250 * time.Millisecond
 
-	for retries > 0 {
+	for attempt := 1; ; attempt++ {
 		request, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(jsonValue))
 		if err != nil {
 			return err
 		}
 		request.Header.Set("Content-Type", "application/json; charset=UTF-8")
-		request.Close = true
-		if resp, err = client.Do(request); err == nil {
+		if m.relay != "" {
+			request.Header.Set(relayHostHeader, m.relay)
+		}
+		// Heartbeats reuse one connection; registering and
+		// deregistering happen once and need not keep one open.
+		request.Close = endpoint != "heartbeat"
+		if resp, postErr = m.client.Do(request); postErr == nil || !retry {
+			break
+		}
+		log.Printf("%s attempt #%v failed: %v; retrying in %v", endpoint, attempt, postErr, backoff)
+		if !sleepContext(m.ctx, backoff) {
 			break
 		}
-		retries -= 1
-		log.Printf("#%v retries remaining", retries)
-		time.Sleep(250 * time.Millisecond)
+		if backoff *= 2; backoff > 4*time.Second {
+			backoff = 4 * time.Second
+		}
 	}
 
-	if err != nil {
-		return fmt.Errorf("POST failed for %+v: %v", boundBackend, err)
+	if postErr != nil {
+		return fmt.Errorf("POST /%s failed for %+v: %v", endpoint, boundBackend, postErr)
 	}
 
 	_, err = io.ReadAll(resp.Body)
@@ -121,12 +292,30 @@ func (c *ServeBackendCmd) Run(p *ProgramCtx) error {
 	resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("registration failed for %+v; Status=%v", boundBackend, resp.Status)
+		return fmt.Errorf("%s failed for %+v; Status=%v", endpoint, boundBackend, resp.Status)
 	}
 
-	if err := g.Wait(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-		return err
+	return nil
+}
+
+func (c *ServeBackendCmd) Run(p *ProgramCtx) error {
+	backend := Backend{
+		Host:        c.Host,
+		Name:        c.Name,
+		Server:      c.Server,
+		TrafficType: mustParseTrafficType(string(c.TrafficType)),
 	}
 
-	return nil
+	log.SetPrefix(fmt.Sprintf("[c %v %v %s] ", os.Getpid(), mustResolveHostIP(), backend.ID()))
+
+	var tlsConfig *tls.Config
+
+	if backend.TrafficType.BackendTLS() {
+		var err error
+		if tlsConfig, err = loadBackendTLSConfig(certStore(path.Join(p.Globals.OutputDir, "certs"))); err != nil {
+			return err
+		}
+	}
+
+	return serveBackend(p.Context, backend, c.ListenAddress, c.BackendOptions, tlsConfig, newMetadataServer(p.Context, fmt.Sprintf("http://127.0.0.1:%d", p.Port)))
 }
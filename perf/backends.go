@@ -7,42 +7,63 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
-	"os/signal"
 	"path"
-	"sync"
+	"strconv"
 	"syscall"
 	"time"
 
 	"golang.org/x/sync/errgroup"
 )
 
+// Backend is one server endpoint of a route. A route has one or
+// more servers, numbered from 0, that share its Name. Servers of the
+// same route may run on several hosts; Host tells them apart.
 type Backend struct {
+	Host        string      `json:"host,omitempty"`
 	Name        string      `json:"name"`
+	Server      int         `json:"server"`
 	TrafficType TrafficType `json:"traffic_type"`
 }
 
+// ID uniquely identifies a backend server across all routes and
+// hosts.
+func (b Backend) ID() string {
+	if b.Host == "" {
+		return fmt.Sprintf("%s/%d", b.Name, b.Server)
+	}
+	return fmt.Sprintf("%s/%s/%d", b.Host, b.Name, b.Server)
+}
+
 type BoundBackend struct {
 	Backend
 
-	ListenAddress string `json:"listen_address"`
-	Port          int    `json:"port"`
+	ListenAddress string         `json:"listen_address"`
+	Port          int            `json:"port"`
+	State         BackendState   `json:"state,omitempty"`
+	Status        *BackendStatus `json:"status,omitempty"`
 }
 
 type BackendsByTrafficType map[TrafficType][]Backend
 type BoundBackendsByTrafficType map[TrafficType][]BoundBackend
 
-func (c *ServeBackendsCmd) spawnBackend(ctx context.Context, backend Backend) error {
+func (c *ServeBackendsCmd) spawnBackend(p *ProgramCtx, backend Backend) (*exec.Cmd, error) {
 	newArgs := []string{
 		"serve-backend",
+		fmt.Sprintf("--host=%s", backend.Host),
 		fmt.Sprintf("--name=%s", backend.Name),
+		fmt.Sprintf("--server=%d", backend.Server),
 		fmt.Sprintf("--traffic-type=%s", backend.TrafficType),
+		fmt.Sprintf("--output-dir=%s", p.OutputDir),
+		fmt.Sprintf("--port=%d", p.Port),
 	}
 	if c.ListenAddress != "127.0.0.1" {
 		newArgs = append(newArgs, fmt.Sprintf("--listen-address=%s", c.ListenAddress))
 	}
+	newArgs = append(newArgs, c.BackendOptions.args()...)
 	cmd := exec.Command(os.Args[0], newArgs...)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
@@ -51,27 +72,82 @@ func (c *ServeBackendsCmd) spawnBackend(ctx context.Context, backend Backend) er
 		Pdeathsig: syscall.SIGTERM,
 	}
 	if err := cmd.Start(); err != nil {
-		return err
+		return nil, err
 	}
-	go cmd.Wait()
-	return nil
+	return cmd, nil
+}
+
+// registrationTimeout is how long n newly started backend servers
+// are given to register: --register-timeout if set, otherwise 15s
+// plus 10ms for each server.
+func (c *ServeBackendsCmd) registrationTimeout(n int) time.Duration {
+	if c.RegisterTimeout > 0 {
+		return c.RegisterTimeout
+	}
+	return 15*time.Second + time.Duration(n)*10*time.Millisecond
 }
 
 func (c *ServeBackendsCmd) Run(p *ProgramCtx) error {
 	log.SetPrefix(fmt.Sprintf("[P %v] %v ", os.Getpid(), mustResolveHostIP()))
 
+	if err := c.Faults.Validate(); err != nil {
+		return err
+	}
+
+	if err := validateHealthPath(c.HealthPath); err != nil {
+		return err
+	}
+
+	if c.HTTP1Only && c.HTTP2 {
+		return fmt.Errorf("--http1-only and --http2 are mutually exclusive")
+	}
+
+	if c.ServersPerBackend < 1 {
+		return fmt.Errorf("--servers-per-backend must be at least 1")
+	}
+
+	if err := c.validateChurn(); err != nil {
+		return err
+	}
+
+	if c.SpawnConcurrency < 1 {
+		return fmt.Errorf("--spawn-concurrency must be at least 1")
+	}
+
+	if c.RegisterWith != "" && c.RootCA != "" {
+		return fmt.Errorf("--root-ca cannot be used with --register-with: the central serve-backends issues the certificates")
+	}
+
+	// Load the root CA before the certs directory is removed; it
+	// may have been written there by an earlier run.
+	rootCA, err := c.rootCA()
+	if err != nil {
+		return err
+	}
+
+	// With --ocsp leaves name the OCSP responder of this metadata
+	// server unless told otherwise. By default they name none, so
+	// that handshakes are not made larger by it.
+	if c.OCSP && c.OCSPURL == "" {
+		c.OCSPURL = fmt.Sprintf("http://%s/ocsp", net.JoinHostPort(mustResolveHostIP(), strconv.Itoa(p.Port)))
+	}
+
 	if err := os.RemoveAll(path.Join(p.OutputDir, "certs")); err != nil {
 		return err
 	}
 
 	var (
 		backendsByTrafficType = BackendsByTrafficType{}
-		backendsReady         = make(chan bool)
-		backendsRegistered    = 0
-		boundBackends         sync.Map
-		registerHandlerLock   sync.Mutex
+		host                  = c.Host
+		registry              *backendRegistry
 	)
 
+	if host == "" {
+		host = mustResolveHostname()
+	}
+
+	registry = newBackendRegistry(host)
+
 	mux := http.NewServeMux()
 
 	httpServer := &http.Server{
@@ -79,45 +155,89 @@ func (c *ServeBackendsCmd) Run(p *ProgramCtx) error {
 		Addr:         fmt.Sprintf("0.0.0.0:%v", p.Port),
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
+		ConnContext:  withConn,
 	}
 
 	g, gCtx := errgroup.WithContext(p.Context)
-	chldSignalCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGCHLD)
-	defer stop()
 
-	g.Go(func() error {
-		select {
-		case <-chldSignalCtx.Done():
-			return fmt.Errorf("a backend died")
-		case <-gCtx.Done():
-			return nil
-		}
-	})
+	supervisor := newBackendSupervisor(c.RestartPolicy)
 
-	mux.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
-		registerHandlerLock.Lock()
-		defer registerHandlerLock.Unlock()
-		if backendsRegistered == len(backendsByTrafficType)*p.Nbackends {
-			http.Error(w, "unexpected registration", http.StatusBadRequest)
-			return
+	// scaler is set before any backend is started.
+	var scaler *backendScaler
+
+	// Backends stopped deliberately, by churn or scaling, are
+	// expected to exit; the supervisor decides whether any other
+	// exit is followed by a restart.
+	exited := func(h *backendHandle) {
+		// A dead backend cannot deregister itself.
+		if b, ok := registry.Lookup(h.backend.ID()); ok {
+			_ = registry.Deregister(b)
 		}
-		if r.Method != http.MethodPost {
-			http.Error(w, r.Method, http.StatusBadRequest)
+		if !supervisor.Died(h) {
 			return
 		}
-		decoder := json.NewDecoder(r.Body)
-		decoder.DisallowUnknownFields()
-		var boundBackend BoundBackend
-		if err := decoder.Decode(&boundBackend); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
+		go func() {
+			select {
+			case <-time.After(c.RestartDelay):
+			case <-gCtx.Done():
+				return
+			}
+			if err := scaler.Restart(h); err != nil {
+				log.Printf("failed to restart backend %s: %v\n", h.backend.ID(), err)
+			}
+		}()
+	}
+
+	// /register, /heartbeat and /deregister take the JSON
+	// BoundBackend of a backend process, or of a backend of
+	// another host relayed by that host's serve-backends.
+	registrationHandler := func(fn func(relay string, b BoundBackend) error) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(w, r.Method, http.StatusBadRequest)
+				return
+			}
+			decoder := json.NewDecoder(r.Body)
+			decoder.DisallowUnknownFields()
+			var boundBackend BoundBackend
+			if err := decoder.Decode(&boundBackend); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := fn(r.Header.Get(relayHostHeader), boundBackend); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 		}
-		boundBackends.Store(boundBackend.Name, boundBackend)
-		backendsRegistered += 1
-		if backendsRegistered == len(backendsByTrafficType)*p.Nbackends {
-			backendsReady <- true
+	}
+
+	register := func(relay string, b BoundBackend) error {
+		if relay == "" {
+			return registry.Register(b)
 		}
-	})
+		return registry.RegisterRelayed(relay, b)
+	}
+
+	mux.HandleFunc("/register", registrationHandler(register))
+	mux.HandleFunc("/heartbeat", registrationHandler(register))
+	mux.HandleFunc("/deregister", registrationHandler(func(_ string, b BoundBackend) error {
+		return registry.Deregister(b)
+	}))
+
+	if c.Heartbeat > 0 {
+		g.Go(func() error {
+			ticker := time.NewTicker(c.Heartbeat)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-gCtx.Done():
+					return nil
+				case <-ticker.C:
+					registry.Expire(3 * c.Heartbeat)
+				}
+			}
+		})
+	}
 
 	g.Go(func() error {
 		return httpServer.ListenAndServe()
@@ -126,7 +246,7 @@ func (c *ServeBackendsCmd) Run(p *ProgramCtx) error {
 	g.Go(func() error {
 		<-gCtx.Done()
 		httpServer.SetKeepAlivesEnabled(false)
-		shutdownCtx, shutdownRelease := context.WithTimeout(context.Background(), httpServer.WriteTimeout)
+		shutdownCtx, shutdownRelease := context.WithTimeout(context.Background(), 15*time.Second)
 		defer shutdownRelease()
 		return httpServer.Shutdown(shutdownCtx)
 	})
@@ -140,64 +260,173 @@ func (c *ServeBackendsCmd) Run(p *ProgramCtx) error {
 		"::1",
 	}
 
-	for _, t := range AllTrafficTypes {
+	for _, t := range p.TrafficTypes() {
 		for i := 0; i < p.Nbackends; i++ {
-			backend := Backend{
-				Name:        fmt.Sprintf("%s-%v-%v", p.HostPrefix, t, i),
-				TrafficType: t,
+			name := fmt.Sprintf("%s-%v-%v", p.HostPrefix, t, i)
+			for server := 0; server < c.ServersPerBackend; server++ {
+				backendsByTrafficType[t] = append(backendsByTrafficType[t], Backend{
+					Host:        host,
+					Name:        name,
+					Server:      server,
+					TrafficType: t,
+				})
 			}
-			backendsByTrafficType[t] = append(backendsByTrafficType[t], backend)
-			subjectAlternateNames = append(subjectAlternateNames, backend.Name)
+			subjectAlternateNames = append(subjectAlternateNames, name)
 		}
 	}
 
 	// Create certificates after we know all the backend names.
-	certBundle, err := CreateTLSCerts(time.Now(), time.Now().AddDate(1, 0, 0), subjectAlternateNames...)
-	if err != nil {
-		return fmt.Errorf("failed to generate certificates: %v", err)
-	}
+	var certs *backendCerts
 
-	if _, err := writeCertificates(path.Join(p.OutputDir, "certs"), certBundle); err != nil {
+	if c.RegisterWith == "" {
+		certs, err = newBackendCerts(path.Join(p.OutputDir, "certs"), c.InProcess, c.CertOptions, rootCA, subjectAlternateNames...)
+	} else {
+		certs, err = newCentralBackendCerts(path.Join(p.OutputDir, "certs"), c.InProcess, c.RegisterWith, subjectAlternateNames...)
+	}
+	if err != nil {
 		return err
 	}
 
-	for t, backends := range backendsByTrafficType {
-		log.Printf("starting %d %s backend(s)\n", p.Nbackends, t)
-		for _, backend := range backends {
-			if err := c.spawnBackend(p.Context, backend); err != nil {
-				return err
+	// GET /certs returns the certificate bundle. Hosts registering
+	// their backends here POST the names they serve first, and
+	// get back a bundle whose leaf covers them.
+	mux.HandleFunc("/certs", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var names []string
+			if err := json.NewDecoder(r.Body).Decode(&names); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
 			}
+			if err := certs.Cover(names...); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		default:
+			http.Error(w, r.Method, http.StatusMethodNotAllowed)
+			return
 		}
-	}
+		data, err := json.MarshalIndent(certs.Bundle(), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := io.WriteString(w, string(data)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	})
+
+	mux.HandleFunc("/ocsp", ocspHandler("/ocsp", certs.Bundle))
+	mux.HandleFunc("/ocsp/", ocspHandler("/ocsp", certs.Bundle))
 
-	select {
-	case <-backendsReady:
-		log.Printf("%d backend(s) processes registered", len(AllTrafficTypes)*p.Nbackends)
-	case <-gCtx.Done():
+	handles := newBackendHandles()
+
+	startBackend := func(backend Backend) error {
+		// A backend removed while it was being restarted
+		// must stay gone.
+		if !registry.Expected(backend.ID()) {
+			return nil
+		}
+		h, err := c.startBackend(gCtx, p, backend, certs.TLSConfig(), registry, exited)
+		if err != nil {
+			return err
+		}
+		handles.Put(h)
+		supervisor.Started(h)
 		return nil
-	case <-time.After(15 * time.Second):
-		return fmt.Errorf("timeout waiting for backends to register")
 	}
 
-	printBackendsForType := func(w io.Writer, t TrafficType) error {
-		for _, b := range backendsByTrafficType[t] {
-			obj, ok := boundBackends.Load(b.Name)
-			if !ok {
-				panic("missing backend registration for" + b.Name)
+	scaler = &backendScaler{
+		certs:             certs,
+		concurrency:       c.SpawnConcurrency,
+		handles:           handles,
+		host:              host,
+		hostPrefix:        p.HostPrefix,
+		registry:          registry,
+		serversPerBackend: c.ServersPerBackend,
+		start:             startBackend,
+		supervisor:        supervisor,
+		timeout:           c.registrationTimeout,
+		trafficTypes:      p.TrafficTypes(),
+	}
+
+	var allBackends []Backend
+
+	for _, t := range p.TrafficTypes() {
+		log.Printf("starting %d %s backend(s) with %d server(s) each\n", p.Nbackends, t, c.ServersPerBackend)
+		allBackends = append(allBackends, backendsByTrafficType[t]...)
+	}
+
+	mode := "processes"
+	if c.InProcess {
+		mode = "goroutines"
+	}
+
+	if err := scaler.Launch(gCtx, allBackends); err != nil {
+		if gCtx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+
+	log.Printf("%d backend server(s) %s registered", len(allBackends), mode)
+
+	// supervisedBackends returns the registered backends together
+	// with their supervision history.
+	supervisedBackends := func(includeStale bool) BoundBackendsByTrafficType {
+		boundBackendsByTrafficType := registry.BoundBackends(includeStale)
+		for _, backends := range boundBackendsByTrafficType {
+			for i := range backends {
+				if status, ok := supervisor.Status(backends[i].ID()); ok {
+					backends[i].Status = &status
+				}
 			}
-			boundBackend, ok := obj.(BoundBackend)
-			if !ok {
-				panic(fmt.Sprintf("unexpected type: %T", obj))
+		}
+		return boundBackendsByTrafficType
+	}
+
+	printBackendsForType := func(w io.Writer, backends []BoundBackend) error {
+		for _, b := range backends {
+			line := fmt.Sprintf("%v %v %v", b.Name, b.ListenAddress, b.Port)
+			if b.State == BackendStale {
+				line += fmt.Sprintf(" state=%v", b.State)
 			}
-			if _, err := io.WriteString(w, fmt.Sprintf("%v %v %v\n", b.Name, boundBackend.ListenAddress, boundBackend.Port)); err != nil {
+			if b.Status != nil && b.Status.Deaths > 0 {
+				line += fmt.Sprintf(" %v", b.Status)
+			}
+			if _, err := io.WriteString(w, line+"\n"); err != nil {
 				return err
 			}
 		}
 		return nil
 	}
 
-	mux.HandleFunc("/certs", func(w http.ResponseWriter, r *http.Request) {
-		data, err := json.MarshalIndent(certBundle, "", "  ")
+	snapshot := func() *Snapshot {
+		return &Snapshot{
+			Backends:     supervisedBackends(false),
+			Certificates: certs.Bundle(),
+			CreatedAt:    time.Now(),
+			Version:      registry.Version(),
+		}
+	}
+
+	snapshotFile := p.Snapshot
+	if snapshotFile == "" {
+		snapshotFile = path.Join(p.OutputDir, "snapshot.json")
+	}
+
+	g.Go(func() error {
+		return snapshotWriter(gCtx, snapshotFile, registry.Changed, snapshot)
+	})
+
+	mux.HandleFunc("/watch", watchHandler(gCtx, registry))
+
+	// /snapshot is the content of the snapshot file, for archiving
+	// the topology from another machine.
+	mux.HandleFunc("/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		data, err := json.MarshalIndent(snapshot(), "", "  ")
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
@@ -208,37 +437,74 @@ func (c *ServeBackendsCmd) Run(p *ProgramCtx) error {
 		}
 	})
 
-	mux.HandleFunc("/backends", func(w http.ResponseWriter, r *http.Request) {
+	// Reissued leaf certificates come from the same root CA, so
+	// the control client never needs rebuilding.
+	controlClient := newControlClient(certs.Bundle())
+
+	// /faults and /health read (GET) or replace (PUT, POST) the
+	// fault injection settings and health state of the backends
+	// selected by the "name" and "traffic-type" query parameters.
+	mux.HandleFunc("/faults", controlBroadcastHandler(controlClient, registry, "faults"))
+	mux.HandleFunc("/health", controlBroadcastHandler(controlClient, registry, "health"))
+
+	// /stats collects the request counters of every backend. GET
+	// reports them, DELETE resets them and reports the values
+	// from before the reset.
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+			http.Error(w, r.Method, http.StatusMethodNotAllowed)
+			return
+		}
+
+		statsByTrafficType := collectBackendStats(controlClient, r.Method, registry.BoundBackends(false))
+
 		if _, ok := r.URL.Query()["json"]; !ok {
-			for _, t := range AllTrafficTypes {
-				if err := printBackendsForType(w, t); err != nil {
-					http.Error(w, err.Error(), http.StatusBadRequest)
+			for _, t := range knownTrafficTypes() {
+				for _, s := range statsByTrafficType[t] {
+					line := fmt.Sprintf("%v %v %v %v requests=%v errors=%v bytes_in=%v bytes_out=%v\n",
+						s.Name, s.Server, s.ListenAddress, s.Port,
+						s.Stats.Requests, s.Stats.Errors, s.Stats.BytesIn, s.Stats.BytesOut)
+					if s.Error != "" {
+						line = fmt.Sprintf("%v %v %v %v error=%q\n", s.Name, s.Server, s.ListenAddress, s.Port, s.Error)
+					}
+					if _, err := io.WriteString(w, line); err != nil {
+						http.Error(w, err.Error(), http.StatusBadRequest)
+						return
+					}
 				}
 			}
 			return
 		}
 
-		var boundBackendsByTrafficType = BoundBackendsByTrafficType{}
+		data, err := json.MarshalIndent(statsByTrafficType, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := io.WriteString(w, string(data)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	})
 
-		for _, t := range AllTrafficTypes {
-			for _, b := range backendsByTrafficType[t] {
-				obj, ok := boundBackends.Load(b.Name)
-				if !ok {
-					panic("missing registration for" + b.Name)
-				}
-				boundBackend, ok := obj.(BoundBackend)
-				if !ok {
-					panic(fmt.Sprintf("unexpected type: %T", obj))
+	// /backends lists the live backends; ?all also lists stale
+	// ones. X-Resource-Version changes whenever a backend
+	// registers, moves to a new port, deregisters or goes stale,
+	// so clients can tell when to refetch.
+	mux.HandleFunc("/backends", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Resource-Version", fmt.Sprint(registry.Version()))
+		_, includeStale := r.URL.Query()["all"]
+		backends := supervisedBackends(includeStale)
+		if _, ok := r.URL.Query()["json"]; !ok {
+			for _, t := range knownTrafficTypes() {
+				if err := printBackendsForType(w, backends[t]); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
 				}
-				boundBackendsByTrafficType[t] = append(boundBackendsByTrafficType[t],
-					BoundBackend{
-						Backend:       b,
-						Port:          boundBackend.Port,
-						ListenAddress: boundBackend.ListenAddress,
-					})
 			}
+			return
 		}
-		data, err := json.MarshalIndent(boundBackendsByTrafficType, "", "  ")
+
+		data, err := json.MarshalIndent(backends, "", "  ")
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
@@ -249,6 +515,27 @@ func (c *ServeBackendsCmd) Run(p *ProgramCtx) error {
 		}
 	})
 
+	// /scale reports (GET) or changes (PUT, POST) the number of
+	// backends of a traffic type, e.g.
+	// /scale?traffic-type=edge&backends=200.
+	mux.Handle("/scale", scaler)
+
+	if c.RegisterWith != "" {
+		log.Printf("registering backends with %s\n", c.RegisterWith)
+		central := newMetadataServer(gCtx, c.RegisterWith)
+		central.relay = host
+		g.Go(func() error {
+			return relayRegistrations(gCtx, registry, central, c.Heartbeat)
+		})
+	}
+
+	if c.ChurnInterval > 0 {
+		g.Go(func() error {
+			c.churnBackends(gCtx, scaler)
+			return nil
+		})
+	}
+
 	log.Printf("metadata server available at http://%s:%v/backends\n", mustResolveHostname(), p.Port)
 
 	if err := g.Wait(); err != nil && !errors.Is(err, http.ErrServerClosed) {
@@ -1,15 +1,15 @@
 package main
 
 import (
-	"bytes"
+	"crypto"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"fmt"
 	"math/big"
 	"net"
+	"strings"
 	"time"
 )
 
@@ -18,20 +18,55 @@ type Certificates struct {
 	LeafKeyPEM    string
 	RootCACertPEM string
 	RootCAKeyPEM  string
+
+	// IntermediateCertsPEM is the chain of intermediate CAs
+	// between the leaf and the root, the leaf's issuer first.
+	// IssuerKeyPEM is the key of that issuer. Both are empty
+	// when the root signs the leaves directly.
+	IntermediateCertsPEM string
+	IssuerKeyPEM         string
+
+	// OCSPServer is the OCSP responder URL put in the leaves, if
+	// set.
+	OCSPServer string
 }
 
-// CreateTLSCerts generates self-signed certificates suitable for
-// client/server tls.Config.
-func CreateTLSCerts(notBefore, notAfter time.Time, alternateNames ...string) (*Certificates, error) {
+func newSerialNumber() (*big.Int, error) {
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate serial number: %v", err)
 	}
+	return serialNumber, nil
+}
+
+func encodeCertificatePEM(der []byte) string {
+	return string(pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: der,
+	}))
+}
+
+func parseCertificatePEM(data string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
 
-	caPrivKey, err := rsa.GenerateKey(rand.Reader, 2048)
+// newCACert creates a CA certificate, with a new key of keyType,
+// signed by parent or, if parent is nil, by itself. maxPathLen is the
+// number of intermediate CAs allowed below it, or -1 for no limit.
+func newCACert(parent *x509.Certificate, parentPrivKey crypto.Signer, keyType KeyType, commonName string, maxPathLen int, notBefore, notAfter time.Time) (*x509.Certificate, crypto.Signer, string, error) {
+	serialNumber, err := newSerialNumber()
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate key: %v", err)
+		return nil, nil, "", err
+	}
+
+	privKey, err := generateKey(keyType)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to generate key: %v", err)
 	}
 
 	ca := x509.Certificate{
@@ -39,37 +74,252 @@ func CreateTLSCerts(notBefore, notAfter time.Time, alternateNames ...string) (*C
 		Subject: pkix.Name{
 			Organization:       []string{"perf development certificate"},
 			OrganizationalUnit: []string{"perf dept"},
-			CommonName:         "perf",
+			CommonName:         commonName,
 		},
 		NotBefore:             notBefore,
 		NotAfter:              notAfter,
 		IsCA:                  true,
 		KeyUsage:              x509.KeyUsageCertSign,
 		BasicConstraintsValid: true,
-		MaxPathLenZero:        true,
+		MaxPathLen:            maxPathLen,
+		MaxPathLenZero:        maxPathLen == 0,
 	}
 
-	caBytes, err := x509.CreateCertificate(rand.Reader, &ca, &ca, &caPrivKey.PublicKey, caPrivKey)
+	if parent == nil {
+		parent, parentPrivKey = &ca, privKey
+	}
+
+	caBytes, err := x509.CreateCertificate(rand.Reader, &ca, parent, privKey.Public(), parentPrivKey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create rooot certificate: %v\n", err)
+		return nil, nil, "", fmt.Errorf("failed to create CA certificate %q: %v", commonName, err)
 	}
 
-	caPEM := new(bytes.Buffer)
-	if err := pem.Encode(caPEM, &pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: caBytes,
-	}); err != nil {
+	cert, err := x509.ParseCertificate(caBytes)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	return cert, privKey, encodeCertificatePEM(caBytes), nil
+}
+
+// CreateRootCA generates a self-signed root CA with a key of keyType.
+// The root is not path length constrained so that it can be reused,
+// through --root-ca, with any number of intermediates.
+func CreateRootCA(keyType KeyType, notBefore, notAfter time.Time) (*Certificates, error) {
+	_, caPrivKey, caPEM, err := newCACert(nil, nil, keyType, "perf", -1, notBefore, notAfter)
+	if err != nil {
+		return nil, err
+	}
+
+	caPrivKeyPEM, err := encodePrivateKeyPEM(caPrivKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Certificates{
+		RootCACertPEM: caPEM,
+		RootCAKeyPEM:  caPrivKeyPEM,
+	}, nil
+}
+
+// CreateTLSCerts generates self-signed certificates suitable for
+// client/server tls.Config. The leaf is signed through a chain of
+// intermediate CAs below the root; all keys are of keyType.
+func CreateTLSCerts(keyType KeyType, intermediates int, notBefore, notAfter time.Time, alternateNames ...string) (*Certificates, error) {
+	rootCA, err := CreateRootCA(keyType, notBefore, notAfter)
+	if err != nil {
+		return nil, err
+	}
+
+	return IssueTLSCerts(rootCA, keyType, intermediates, notBefore, notAfter, alternateNames...)
+}
+
+// IssueTLSCerts generates certificates like CreateTLSCerts but from
+// the existing root CA in rootCA, so that clients that already trust
+// it need not be changed. An empty keyType uses the type of the root
+// CA key. Leaves do not outlive the root, and name rootCA.OCSPServer,
+// if set, as their OCSP responder.
+func IssueTLSCerts(rootCA *Certificates, keyType KeyType, intermediates int, notBefore, notAfter time.Time, alternateNames ...string) (*Certificates, error) {
+	if intermediates < 0 {
+		return nil, fmt.Errorf("invalid number of intermediate CAs %d", intermediates)
+	}
+
+	ca, err := parseCertificatePEM(rootCA.RootCACertPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse root certificate: %v", err)
+	}
+
+	if !ca.IsCA {
+		return nil, fmt.Errorf("root certificate %q is not a CA", ca.Subject)
+	}
+
+	if ca.MaxPathLen >= 0 && intermediates > ca.MaxPathLen {
+		return nil, fmt.Errorf("root certificate %q allows at most %d intermediate CAs", ca.Subject, ca.MaxPathLen)
+	}
+
+	caPrivKey, err := parsePrivateKeyPEM(rootCA.RootCAKeyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse root key: %v", err)
+	}
+
+	if keyType == "" {
+		if keyType, err = keyTypeOf(caPrivKey); err != nil {
+			return nil, err
+		}
+	}
+
+	if notAfter.After(ca.NotAfter) {
+		notAfter = ca.NotAfter
+	}
+
+	certs := Certificates{
+		OCSPServer:    rootCA.OCSPServer,
+		RootCACertPEM: rootCA.RootCACertPEM,
+		RootCAKeyPEM:  rootCA.RootCAKeyPEM,
+	}
+
+	return issueIntermediates(certs, ca, caPrivKey, keyType, intermediates, notBefore, notAfter, alternateNames...)
+}
+
+// issueIntermediates creates a chain of intermediate CAs below ca
+// and issues the leaf from the last of them.
+func issueIntermediates(certs Certificates, ca *x509.Certificate, caPrivKey crypto.Signer, keyType KeyType, intermediates int, notBefore, notAfter time.Time, alternateNames ...string) (*Certificates, error) {
+	issuer, issuerPrivKey := ca, caPrivKey
+
+	var chain []string
+
+	for i := 0; i < intermediates; i++ {
+		var (
+			pemData string
+			err     error
+		)
+		issuer, issuerPrivKey, pemData, err = newCACert(issuer, issuerPrivKey, keyType, fmt.Sprintf("perf intermediate %d", i+1), intermediates-1-i, notBefore, notAfter)
+		if err != nil {
+			return nil, err
+		}
+		chain = append([]string{pemData}, chain...)
+	}
+
+	if intermediates > 0 {
+		issuerKeyPEM, err := encodePrivateKeyPEM(issuerPrivKey)
+		if err != nil {
+			return nil, err
+		}
+		certs.IntermediateCertsPEM = strings.Join(chain, "")
+		certs.IssuerKeyPEM = issuerKeyPEM
+	}
+
+	return issueLeafCert(issuer, issuerPrivKey, certs, keyType, notBefore, notAfter, alternateNames...)
+}
+
+// ReissueTLSCerts issues a new leaf certificate for alternateNames
+// signed by the same issuer as the leaf in certs, so that anything
+// already trusting that root CA continues to work. An empty keyType
+// uses the type of the issuer's key.
+func ReissueTLSCerts(certs *Certificates, keyType KeyType, notBefore, notAfter time.Time, alternateNames ...string) (*Certificates, error) {
+	issuer, issuerPrivKey, err := leafIssuer(certs)
+	if err != nil {
+		return nil, err
+	}
+
+	if keyType == "" {
+		if keyType, err = keyTypeOf(issuerPrivKey); err != nil {
+			return nil, err
+		}
+	}
+
+	return issueLeafCert(issuer, issuerPrivKey, *certs, keyType, notBefore, notAfter, alternateNames...)
+}
+
+// IssueClientCert issues a client certificate for commonName from the
+// issuer of the leaves in certs, returned as the leaf of a copy of
+// certs. An empty keyType uses the type of the issuer's key.
+func IssueClientCert(certs *Certificates, keyType KeyType, notBefore, notAfter time.Time, commonName string) (*Certificates, error) {
+	issuer, issuerPrivKey, err := leafIssuer(certs)
+	if err != nil {
+		return nil, err
+	}
+
+	if keyType == "" {
+		if keyType, err = keyTypeOf(issuerPrivKey); err != nil {
+			return nil, err
+		}
+	}
+
+	serialNumber, err := newSerialNumber()
+	if err != nil {
 		return nil, err
 	}
 
-	caPrivKeyPEM := new(bytes.Buffer)
-	if err := pem.Encode(caPrivKeyPEM, &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(caPrivKey),
-	}); err != nil {
+	certPrivKey, err := generateKey(keyType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %v", err)
+	}
+
+	cert := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization:       []string{"perf development certificate"},
+			OrganizationalUnit: []string{"perf dept"},
+			CommonName:         commonName,
+		},
+		NotBefore:   notBefore,
+		NotAfter:    notAfter,
+		KeyUsage:    keyUsage(certPrivKey),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	certBytes, err := x509.CreateCertificate(rand.Reader, &cert, issuer, certPrivKey.Public(), issuerPrivKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client certificate: %v", err)
+	}
+
+	certPrivKeyPEM, err := encodePrivateKeyPEM(certPrivKey)
+	if err != nil {
 		return nil, err
 	}
 
+	client := *certs
+	client.LeafCertPEM = encodeCertificatePEM(certBytes)
+	client.LeafKeyPEM = certPrivKeyPEM
+
+	return &client, nil
+}
+
+// leafIssuer returns the CA, and its key, that signs the leaves of
+// certs: the last intermediate or, if there are none, the root.
+func leafIssuer(certs *Certificates) (*x509.Certificate, crypto.Signer, error) {
+	issuerPEM, issuerKeyPEM := certs.RootCACertPEM, certs.RootCAKeyPEM
+	if certs.IntermediateCertsPEM != "" {
+		issuerPEM, issuerKeyPEM = certs.IntermediateCertsPEM, certs.IssuerKeyPEM
+	}
+
+	issuer, err := parseCertificatePEM(issuerPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse issuer certificate: %v", err)
+	}
+
+	issuerPrivKey, err := parsePrivateKeyPEM(issuerKeyPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse issuer key: %v", err)
+	}
+
+	return issuer, issuerPrivKey, nil
+}
+
+// issueLeafCert returns certs with a new leaf, signed by ca, in place
+// of its current one.
+func issueLeafCert(ca *x509.Certificate, caPrivKey crypto.Signer, certs Certificates, keyType KeyType, notBefore, notAfter time.Time, alternateNames ...string) (*Certificates, error) {
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	certPrivKey, err := generateKey(keyType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %v", err)
+	}
+
 	// server certificate
 	cert := x509.Certificate{
 		SerialNumber: serialNumber,
@@ -80,48 +330,45 @@ func CreateTLSCerts(notBefore, notAfter time.Time, alternateNames ...string) (*C
 		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
 		NotBefore:   notBefore,
 		NotAfter:    notAfter,
-		KeyUsage:    x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		KeyUsage:    keyUsage(certPrivKey),
 		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
 	}
 
+	if certs.OCSPServer != "" {
+		cert.OCSPServer = []string{certs.OCSPServer}
+	}
+
+	// Names may repeat, for example when reissuing for the names
+	// of an earlier leaf; list each once.
+	seen := map[string]bool{}
+	for _, ip := range cert.IPAddresses {
+		seen[ip.String()] = true
+	}
+
 	for _, host := range alternateNames {
 		if ip := net.ParseIP(host); ip != nil {
-			cert.IPAddresses = append(cert.IPAddresses, ip)
-		} else {
+			if !seen[ip.String()] {
+				cert.IPAddresses = append(cert.IPAddresses, ip)
+			}
+			seen[ip.String()] = true
+		} else if !seen[host] {
 			cert.DNSNames = append(cert.DNSNames, host)
+			seen[host] = true
 		}
 	}
 
-	certPrivKey, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate key: %v", err)
-	}
-
-	certBytes, err := x509.CreateCertificate(rand.Reader, &cert, &ca, &certPrivKey.PublicKey, caPrivKey)
+	certBytes, err := x509.CreateCertificate(rand.Reader, &cert, ca, certPrivKey.Public(), caPrivKey)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create leaf certificate: %v", err)
 	}
 
-	certPEM := new(bytes.Buffer)
-	if err := pem.Encode(certPEM, &pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: certBytes,
-	}); err != nil {
+	certPrivKeyPEM, err := encodePrivateKeyPEM(certPrivKey)
+	if err != nil {
 		return nil, err
 	}
 
-	certPrivKeyPEM := new(bytes.Buffer)
-	if err := pem.Encode(certPrivKeyPEM, &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(certPrivKey),
-	}); err != nil {
-		return nil, err
-	}
+	certs.LeafCertPEM = encodeCertificatePEM(certBytes)
+	certs.LeafKeyPEM = certPrivKeyPEM
 
-	return &Certificates{
-		LeafCertPEM:   certPEM.String(),
-		LeafKeyPEM:    certPrivKeyPEM.String(),
-		RootCACertPEM: caPEM.String(),
-		RootCAKeyPEM:  caPrivKeyPEM.String(),
-	}, nil
+	return &certs, nil
 }
@@ -13,7 +13,7 @@ import (
 )
 
 func TestCertGen(t *testing.T) {
-	certBundle, err := CreateTLSCerts(time.Now(), time.Now().AddDate(1, 0, 0),
+	certBundle, err := CreateTLSCerts(KeyTypeRSA2048, 0, time.Now(), time.Now().AddDate(1, 0, 0),
 		mustResolveHostname(),
 		mustResolveHostIP(),
 		"localhost",
@@ -72,3 +72,120 @@ func TestCertGen(t *testing.T) {
 		t.Fatalf(`expected "success", got %q`, body)
 	}
 }
+
+func TestCertGenIntermediates(t *testing.T) {
+	certBundle, err := CreateTLSCerts(KeyTypeECDSAP256, 2, time.Now(), time.Now().AddDate(1, 0, 0), "localhost")
+	if err != nil {
+		t.Fatalf("failed to generate certificates: %v", err)
+	}
+
+	reissued, err := ReissueTLSCerts(certBundle, "", time.Now(), time.Now().AddDate(1, 0, 0), "reissued.example")
+	if err != nil {
+		t.Fatalf("failed to reissue certificates: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM([]byte(certBundle.RootCACertPEM))
+
+	intermediates := x509.NewCertPool()
+	if !intermediates.AppendCertsFromPEM([]byte(certBundle.IntermediateCertsPEM)) {
+		t.Fatal("expected intermediate certificates")
+	}
+
+	for name, certs := range map[string]*Certificates{"localhost": certBundle, "reissued.example": reissued} {
+		leaf, err := parseCertificatePEM(certs.LeafCertPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		chains, err := leaf.Verify(x509.VerifyOptions{
+			DNSName:       name,
+			Intermediates: intermediates,
+			Roots:         roots,
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if got := len(chains[0]); got != 4 {
+			t.Errorf("%s: expected a chain of 4 certificates, got %d", name, got)
+		}
+	}
+}
+
+func TestReuseRootCA(t *testing.T) {
+	first, err := CreateTLSCerts(KeyTypeECDSAP256, 0, time.Now(), time.Now().AddDate(1, 0, 0), "localhost")
+	if err != nil {
+		t.Fatalf("failed to generate certificates: %v", err)
+	}
+
+	store, err := writeCertificates(t.TempDir(), first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := CertOptions{
+		Intermediates: 1,
+		KeyType:       KeyTypeECDSAP256,
+		RootCA:        store.RootCAFile,
+		RootCAKey:     store.RootCAKeyFile,
+		Validity:      24 * time.Hour,
+	}
+
+	rootCA, err := opts.rootCA()
+	if err != nil {
+		t.Fatalf("failed to load root CA: %v", err)
+	}
+
+	second, err := opts.issue(rootCA, "reissued.example")
+	if err != nil {
+		t.Fatalf("failed to issue certificates: %v", err)
+	}
+
+	if strings.TrimSpace(second.RootCACertPEM) != strings.TrimSpace(first.RootCACertPEM) {
+		t.Error("expected the same root CA")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM([]byte(first.RootCACertPEM))
+
+	intermediates := x509.NewCertPool()
+	intermediates.AppendCertsFromPEM([]byte(second.IntermediateCertsPEM))
+
+	leaf, err := parseCertificatePEM(second.LeafCertPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "reissued.example", Intermediates: intermediates, Roots: roots}); err != nil {
+		t.Errorf("leaf issued from the reloaded root CA does not verify against the original: %v", err)
+	}
+
+	other, err := CreateRootCA(KeyTypeECDSAP256, time.Now(), time.Now().AddDate(1, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherStore, err := writeCertificates(t.TempDir(), other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		certFile string
+		keyFile  string
+	}{
+		{name: "non-CA certificate", certFile: store.TLSCertFile, keyFile: store.TLSKeyFile},
+		{name: "mismatched key", certFile: store.RootCAFile, keyFile: otherStore.RootCAKeyFile},
+	} {
+		opts.RootCA, opts.RootCAKey = tc.certFile, tc.keyFile
+		rootCA, err := opts.rootCA()
+		if err == nil {
+			_, err = opts.issue(rootCA, "localhost")
+		}
+		if err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+}
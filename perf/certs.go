@@ -1,56 +1,67 @@
 package main
 
 import (
+	"crypto/tls"
+	"fmt"
+	"log"
 	"os"
 	"path"
+	"runtime"
 	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
 )
 
 type CertStore struct {
-	DomainFile    string
-	RootCAFile    string
-	RootCAKeyFile string
-	TLSCertFile   string
-	TLSKeyFile    string
+	DomainFile         string
+	IntermediateCAFile string
+	RootCAFile         string
+	RootCAKeyFile      string
+	TLSCertFile        string
+	TLSKeyFile         string
 }
 
 func certStore(certDir string) CertStore {
 	return CertStore{
-		DomainFile:    path.Join(certDir, "domain.pem"),
-		RootCAFile:    path.Join(certDir, "rootCA.pem"),
-		RootCAKeyFile: path.Join(certDir, "rootCA-key.pem"),
-		TLSKeyFile:    path.Join(certDir, "tls.key"),
-		TLSCertFile:   path.Join(certDir, "tls.crt"),
+		DomainFile:         path.Join(certDir, "domain.pem"),
+		IntermediateCAFile: path.Join(certDir, "intermediateCA.pem"),
+		RootCAFile:         path.Join(certDir, "rootCA.pem"),
+		RootCAKeyFile:      path.Join(certDir, "rootCA-key.pem"),
+		TLSKeyFile:         path.Join(certDir, "tls.key"),
+		TLSCertFile:        path.Join(certDir, "tls.crt"),
 	}
 }
 
+// writeCertificates writes certs to dir. Only its own files are
+// replaced: the HAProxy and client certificates in subdirectories of
+// dir survive serve-backends reissuing its leaf.
 func writeCertificates(dir string, certs *Certificates) (*CertStore, error) {
-	if err := os.RemoveAll(dir); err != nil {
-		return nil, err
-	}
-
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return nil, err
 	}
 
 	certPath := certStore(dir)
 
-	domainPEM := strings.Join([]string{
-		strings.TrimSuffix(certs.LeafCertPEM, "\n"),
-		strings.TrimSuffix(certs.LeafKeyPEM, "\n"),
-		strings.TrimSuffix(certs.RootCACertPEM, "\n"),
-	}, "\n")
-
 	for _, cert := range []struct {
 		filename string
 		pemData  string
 	}{
-		{certPath.DomainFile, domainPEM},
+		{certPath.DomainFile, domainPEM(certs)},
+		{certPath.IntermediateCAFile, certs.IntermediateCertsPEM},
 		{certPath.RootCAFile, certs.RootCACertPEM},
 		{certPath.RootCAKeyFile, certs.RootCAKeyPEM},
-		{certPath.TLSCertFile, certs.LeafCertPEM},
+		{certPath.TLSCertFile, certs.LeafCertPEM + certs.IntermediateCertsPEM},
 		{certPath.TLSKeyFile, certs.LeafKeyPEM},
 	} {
+		if cert.pemData == "" {
+			// Leave nothing behind from an earlier bundle.
+			if err := os.Remove(cert.filename); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			continue
+		}
 		if err := createFile(cert.filename, []byte(strings.TrimSuffix(cert.pemData, "\n"))); err != nil {
 			return nil, err
 		}
@@ -58,3 +69,359 @@ func writeCertificates(dir string, certs *Certificates) (*CertStore, error) {
 
 	return &certPath, nil
 }
+
+// domainPEM is the leaf certificate, its key and the chain up to and
+// including the root CA in one file, as HAProxy loads them.
+func domainPEM(certs *Certificates) string {
+	pemData := []string{
+		strings.TrimSuffix(certs.LeafCertPEM, "\n"),
+		strings.TrimSuffix(certs.LeafKeyPEM, "\n"),
+	}
+	if certs.IntermediateCertsPEM != "" {
+		pemData = append(pemData, strings.TrimSuffix(certs.IntermediateCertsPEM, "\n"))
+	}
+	return strings.Join(append(pemData, strings.TrimSuffix(certs.RootCACertPEM, "\n")), "\n")
+}
+
+// writeRouteCertificates issues a leaf certificate for each route
+// name from the root CA of certs and writes it, as a domain PEM, to
+// dir/<name>.pem. It returns the files by route name.
+func writeRouteCertificates(dir string, certs *Certificates, names []string) (map[string]string, error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	var (
+		mu    sync.Mutex
+		files = make(map[string]string, len(names))
+		g     errgroup.Group
+	)
+
+	// Key generation dominates; spread it across the CPUs.
+	g.SetLimit(runtime.NumCPU())
+
+	for _, name := range names {
+		name := name
+		g.Go(func() error {
+			routeCerts, err := ReissueTLSCerts(certs, "", time.Now(), time.Now().AddDate(1, 0, 0), name)
+			if err != nil {
+				return fmt.Errorf("failed to issue certificate for %s: %v", name, err)
+			}
+			filename := path.Join(dir, name+".pem")
+			if err := createFile(filename, []byte(domainPEM(routeCerts))); err != nil {
+				return err
+			}
+			mu.Lock()
+			files[name] = filename
+			mu.Unlock()
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// writeClientCertificates issues a client certificate for each name
+// from the issuer of certs and writes it, with the intermediates, to
+// <dir>/<name>.crt and its key to <dir>/<name>.key. <dir>/<name>.pem
+// holds both, as HAProxy loads them. It returns the certificate
+// files.
+func writeClientCertificates(dir string, certs *Certificates, keyType KeyType, validity time.Duration, names ...string) ([]string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	var files []string
+
+	for _, name := range names {
+		clientCerts, err := IssueClientCert(certs, keyType, time.Now(), time.Now().Add(validity), name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to issue client certificate %s: %v", name, err)
+		}
+		certFile, keyFile := path.Join(dir, name+".crt"), path.Join(dir, name+".key")
+		if err := createFile(certFile, []byte(clientCerts.LeafCertPEM+clientCerts.IntermediateCertsPEM)); err != nil {
+			return nil, err
+		}
+		if err := createFile(keyFile, []byte(clientCerts.LeafKeyPEM)); err != nil {
+			return nil, err
+		}
+		if err := createFile(path.Join(dir, name+".pem"), []byte(domainPEM(clientCerts))); err != nil {
+			return nil, err
+		}
+		files = append(files, certFile)
+	}
+
+	return files, nil
+}
+
+// backendCerts holds the certificates used by the backends and
+// reissues the leaf, from the same root CA, when backend names that
+// it does not cover are added.
+type backendCerts struct {
+	sync.Mutex
+
+	bundle    *Certificates
+	dir       string
+	inProcess bool
+	issue     func(names []string) (*Certificates, error)
+	names     []string
+	tlsConfig *tls.Config
+}
+
+// newBackendCerts issues the backend certificates from rootCA or, if
+// it is nil, from a new root CA.
+func newBackendCerts(dir string, inProcess bool, opts CertOptions, rootCA *Certificates, names ...string) (*backendCerts, error) {
+	bundle, err := opts.issue(rootCA, names...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate certificates: %v", err)
+	}
+
+	c := &backendCerts{
+		dir:       dir,
+		inProcess: inProcess,
+		names:     names,
+	}
+
+	c.issue = func(names []string) (*Certificates, error) {
+		return ReissueTLSCerts(c.bundle, "", time.Now(), time.Now().AddDate(1, 0, 0), names...)
+	}
+
+	if err := c.install(bundle); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// newCentralBackendCerts has the central serve-backends at url issue
+// the certificates, so that backends on every host share its root CA
+// and its leaf covers all their names.
+func newCentralBackendCerts(dir string, inProcess bool, url string, names ...string) (*backendCerts, error) {
+	c := &backendCerts{
+		dir:       dir,
+		inProcess: inProcess,
+		names:     names,
+	}
+
+	c.issue = func(names []string) (*Certificates, error) {
+		return requestCertificates(url, names)
+	}
+
+	bundle, err := c.issue(names)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch certificates from %s: %v", url, err)
+	}
+
+	if err := c.install(bundle); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// install writes bundle to disk and, for in-process backends, loads
+// it; the caller must hold the lock unless c is not yet shared.
+func (c *backendCerts) install(bundle *Certificates) error {
+	if _, err := writeCertificates(c.dir, bundle); err != nil {
+		return err
+	}
+
+	if c.inProcess {
+		tlsConfig, err := loadBackendTLSConfig(certStore(c.dir))
+		if err != nil {
+			return err
+		}
+		c.tlsConfig = tlsConfig
+	}
+
+	c.bundle = bundle
+	return nil
+}
+
+func (c *backendCerts) Bundle() *Certificates {
+	c.Lock()
+	defer c.Unlock()
+	return c.bundle
+}
+
+// TLSConfig is the configuration for in-process backends.
+func (c *backendCerts) TLSConfig() *tls.Config {
+	c.Lock()
+	defer c.Unlock()
+	return c.tlsConfig
+}
+
+// Cover reissues the leaf certificate if any of names is not yet one
+// of its subject alternative names.
+func (c *backendCerts) Cover(names ...string) error {
+	c.Lock()
+	defer c.Unlock()
+
+	known := map[string]bool{}
+	for _, name := range c.names {
+		known[name] = true
+	}
+
+	missing := false
+	for _, name := range names {
+		if !known[name] {
+			known[name] = true
+			c.names = append(c.names, name)
+			missing = true
+		}
+	}
+
+	if !missing {
+		return nil
+	}
+
+	bundle, err := c.issue(c.names)
+	if err != nil {
+		return fmt.Errorf("failed to reissue certificates: %v", err)
+	}
+
+	log.Printf("reissued leaf certificate for %d name(s)\n", len(c.names))
+	return c.install(bundle)
+}
+
+// Run writes certificates for the backend names to
+// <output-dir>/certs, as serve-backends does, so that HAProxy and
+// clients can be set up before any backends are started.
+func (c *GenCertsCmd) Run(p *ProgramCtx) error {
+	names := []string{
+		mustResolveHostname(),
+		mustResolveHostIP(),
+		"localhost",
+		"127.0.0.1",
+		"::1",
+	}
+
+	for _, t := range p.TrafficTypes() {
+		for i := 0; i < p.Nbackends; i++ {
+			names = append(names, fmt.Sprintf("%s-%v-%v", p.HostPrefix, t, i))
+		}
+	}
+
+	for _, name := range c.Names {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+
+	rootCA, err := c.rootCA()
+	if err != nil {
+		return err
+	}
+
+	bundle, err := c.issue(rootCA, names...)
+	if err != nil {
+		return fmt.Errorf("failed to generate certificates: %v", err)
+	}
+
+	certPath, err := writeCertificates(path.Join(p.OutputDir, "certs"), bundle)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s certificates written to %s\n", c.KeyType, path.Dir(certPath.DomainFile))
+	return nil
+}
+
+// Run issues client certificates, from the CA of the running
+// serve-backends or of the snapshot, to <output-dir>/certs/clients.
+func (c *GenClientCertsCmd) Run(p *ProgramCtx) error {
+	if c.Count < 1 {
+		return fmt.Errorf("--count must be at least 1")
+	}
+
+	certBundle, err := certificates(p)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, c.Count)
+	for i := range names {
+		names[i] = fmt.Sprintf("client-%d", i)
+	}
+
+	files, err := writeClientCertificates(path.Join(p.OutputDir, "certs", "clients"), certBundle, c.KeyType, c.Validity, names...)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		fmt.Println(file)
+	}
+
+	return nil
+}
+
+// Run prints the root CA of the running serve-backends, or of the
+// snapshot, as PEM.
+func (c *PrintCACmd) Run(p *ProgramCtx) error {
+	certBundle, err := certificates(p)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Print(certBundle.RootCACertPEM)
+	return err
+}
+
+// rootCA loads the root CA given by --root-ca and --root-ca-key. It
+// returns nil if neither is set.
+func (o CertOptions) rootCA() (*Certificates, error) {
+	if o.RootCA == "" && o.RootCAKey == "" {
+		return nil, nil
+	}
+	if o.RootCA == "" || o.RootCAKey == "" {
+		return nil, fmt.Errorf("--root-ca and --root-ca-key must be set together")
+	}
+	return loadRootCA(o.RootCA, o.RootCAKey)
+}
+
+// issue issues certificates for names from rootCA or, if it is nil,
+// from a new root CA.
+func (o CertOptions) issue(rootCA *Certificates, names ...string) (*Certificates, error) {
+	notBefore, notAfter := time.Now(), time.Now().Add(o.Validity)
+	if rootCA == nil {
+		var err error
+		if rootCA, err = CreateRootCA(o.KeyType, notBefore, notAfter); err != nil {
+			return nil, err
+		}
+	}
+	withOCSP := *rootCA
+	withOCSP.OCSPServer = o.OCSPURL
+	return IssueTLSCerts(&withOCSP, o.KeyType, o.Intermediates, notBefore, notAfter, names...)
+}
+
+// loadRootCA reads a root CA certificate and its key, as written to
+// rootCA.pem and rootCA-key.pem, and checks that they belong
+// together.
+func loadRootCA(certFile, keyFile string) (*Certificates, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		return nil, fmt.Errorf("root CA %s and key %s: %v", certFile, keyFile, err)
+	}
+
+	return &Certificates{
+		RootCACertPEM: string(certPEM),
+		RootCAKeyPEM:  string(keyPEM),
+	}, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+func (c *ServeBackendsCmd) validateChurn() error {
+	if c.ChurnInterval < 0 {
+		return fmt.Errorf("--churn-interval must not be negative")
+	}
+	if c.ChurnFraction <= 0 || c.ChurnFraction > 1 {
+		return fmt.Errorf("--churn-fraction must be in (0, 1]")
+	}
+	return nil
+}
+
+// churnBackends restarts a random share of the running backends every
+// --churn-interval until ctx is done. Each replacement listens on a
+// new ephemeral port and registers before the backend it replaces is
+// stopped, so the metadata server publishes a port change rather than
+// a removal. The scaler's lock is held for each round so that churn
+// does not race with scaling.
+func (c *ServeBackendsCmd) churnBackends(ctx context.Context, s *backendScaler) {
+	ticker := time.NewTicker(c.ChurnInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		c.churnRound(ctx, s)
+	}
+}
+
+// churnRound replaces the victims of one round. A replacement that
+// fails to start or to register is logged and abandoned, and the
+// backend it was to replace keeps running.
+func (c *ServeBackendsCmd) churnRound(ctx context.Context, s *backendScaler) {
+	s.Lock()
+	defer s.Unlock()
+
+	all := s.handles.All()
+	n := int(math.Ceil(c.ChurnFraction * float64(len(all))))
+	victims := make([]*backendHandle, 0, n)
+	for _, i := range rand.Perm(len(all))[:n] {
+		victims = append(victims, all[i])
+	}
+
+	log.Printf("churn: restarting %d of %d backend server(s)\n", len(victims), len(all))
+
+	g := errgroup.Group{}
+	g.SetLimit(64)
+	for _, h := range victims {
+		h := h
+		g.Go(func() error {
+			if err := c.replace(ctx, s, h); err != nil {
+				log.Printf("churn: %v\n", err)
+			}
+			return nil
+		})
+	}
+	_ = g.Wait()
+}
+
+// replace starts a replacement for h and stops h once the
+// replacement has registered. Should the replacement not register in
+// time it is stopped instead and h stays where it was.
+func (c *ServeBackendsCmd) replace(ctx context.Context, s *backendScaler, h *backendHandle) error {
+	id := h.backend.ID()
+	old, registered := s.registry.Lookup(id)
+
+	if err := s.start(h.backend); err != nil {
+		return fmt.Errorf("failed to start replacement of %s: %v", id, err)
+	}
+
+	if err := awaitMove(ctx, s.registry, id, old, c.registrationTimeout(1)); err != nil {
+		if replacement, ok := s.handles.Get(id); ok && replacement != h {
+			s.handles.Put(h)
+			s.supervisor.Started(h)
+			replacement.Stop()
+			// The replacement may have registered after all
+			// and deregistered on its way out.
+			if registered {
+				_ = s.registry.Register(old)
+			}
+		}
+		return err
+	}
+
+	h.Stop()
+	return nil
+}
+
+// awaitMove waits until the backend with id is live somewhere other
+// than old.
+func awaitMove(ctx context.Context, registry *backendRegistry, id string, old BoundBackend, timeout time.Duration) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		changed := registry.Changed()
+		if current, ok := registry.Lookup(id); ok && current != old {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil
+		case <-deadline.C:
+			return fmt.Errorf("timeout waiting for replacement of %s to register", id)
+		}
+	}
+}
@@ -20,7 +20,7 @@ type fetchResult struct {
 	err  error
 }
 
-func newHTTPClient() *http.Client {
+func newHTTPClient(tlsConfig *tls.Config) *http.Client {
 	return &http.Client{
 		Transport: &http.Transport{
 			DialContext: (&net.Dialer{
@@ -33,13 +33,46 @@ func newHTTPClient() *http.Client {
 			MaxIdleConnsPerHost:   0, // no limit
 			MaxConnsPerHost:       0, // no limit
 			DisableKeepAlives:     false,
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
+			TLSClientConfig:       tlsConfig,
 		},
 	}
 }
 
+// clientTLSConfig is the TLS configuration of the test clients:
+// HAProxy's certificates are not verified, and the client certificate
+// is presented if one was given.
+func (c *TestCmd) clientTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true,
+	}
+
+	if c.ClientCert == "" && c.ClientKey == "" {
+		return tlsConfig, nil
+	}
+
+	if c.ClientCert == "" || c.ClientKey == "" {
+		return nil, fmt.Errorf("--client-cert and --client-key must be set together")
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.Certificates = []tls.Certificate{cert}
+
+	return tlsConfig, nil
+}
+
+// testPort is the HAProxy port that serves scheme.
+func testPort(p *ProgramCtx, scheme string) int {
+	switch scheme {
+	case "http":
+		return p.HTTPPort
+	default:
+		return p.HTTPSPort
+	}
+}
+
 func (c *TestCmd) Run(p *ProgramCtx) error {
 	data, err := os.ReadFile(c.RequestFile)
 	if err != nil {
@@ -54,6 +87,18 @@ func (c *TestCmd) Run(p *ProgramCtx) error {
 		return nil
 	}
 
+	tlsConfig, err := c.clientTLSConfig()
+	if err != nil {
+		return err
+	}
+
+	switch c.Mode {
+	case "websocket":
+		return c.runWebSocket(p, requests, tlsConfig)
+	case "grpc":
+		return c.runGRPC(p, requests, tlsConfig)
+	}
+
 	resultCh := make(chan *fetchResult)
 	requestCh := make(chan *http.Request)
 
@@ -72,24 +117,15 @@ func (c *TestCmd) Run(p *ProgramCtx) error {
 		}
 	}
 
-	port := func(scheme string) int {
-		switch scheme {
-		case "http":
-			return p.HTTPPort
-		default:
-			return p.HTTPSPort
-		}
-	}
-
 	pendingRequests := []*http.Request{}
 
 	for i := 0; i < requests[0].Clients; i++ {
-		go fetcher(newHTTPClient())
+		go fetcher(newHTTPClient(tlsConfig))
 		for j := range requests {
 			url := fmt.Sprintf("%v://%v:%v%v",
 				requests[j].Scheme,
 				requests[j].Host,
-				port(requests[j].Scheme),
+				testPort(p, requests[j].Scheme),
 				requests[j].Path)
 			req, err := http.NewRequest("GET", url, nil)
 			if err != nil {
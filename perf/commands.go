@@ -2,12 +2,14 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"time"
 )
 
 type Globals struct {
 	Debug            bool        `help:"Enable debug mode" short:"D" default:"false"`
 	DiscoveryURL     string      `help:"Backend metadata discovery URL" short:"u" default:"http://localhost:2000"`
+	GRPC             bool        `name:"grpc" help:"Also serve gRPC (h2c) backends and generate gRPC workloads." default:"false"`
 	HTTPPort         int         `help:"HAProxy HTTP port" default:"8080"`
 	HTTPSPort        int         `help:"HAProxy HTTPS port" default:"8443"`
 	HTTPSPortSNIOnly int         `help:"HAProxy HTTPS port for SNI-only traffic" default:"9443"`
@@ -16,6 +18,7 @@ type Globals struct {
 	OutputDir        string      `help:"Configuration output directory" short:"o" default:"testrun"`
 	Port             int         `help:"Port number for backend metadata server" short:"p" default:"2000"`
 	Profile          bool        `help:"Record a CPU profile." short:"P"`
+	Snapshot         string      `help:"Topology snapshot file: written by serve-backends (default <output-dir>/snapshot.json) and, if set, read by the generators instead of querying the discovery URL."`
 	TLSReuse         bool        `help:"Enable TLS session reuse" default:"true"`
 	Version          VersionFlag `help:"Print version information and quit."`
 }
@@ -23,9 +26,13 @@ type Globals struct {
 type CLI struct {
 	Globals
 
+	GenCerts       GenCertsCmd       `cmd:"" help:"Generate a root CA and a leaf certificate for the backends."`
+	GenClientCerts GenClientCertsCmd `cmd:"" help:"Issue client certificates from the test CA."`
 	GenHosts       GenHostsCmd       `cmd:"" help:"Generate host names (/etc/hosts compatible)."`
 	GenProxyConfig GenProxyConfigCmd `cmd:"" help:"Generate HAProxy configuration."`
 	GenWorkload    GenWorkloadCmd    `cmd:"" help:"Generate https://github.com/jmencak/mb requests."`
+	PrintCA        PrintCACmd        `cmd:"" name:"print-ca" help:"Print the root CA certificate for installation into trust stores."`
+	RotateCerts    RotateCertsCmd    `cmd:"" help:"Periodically reissue the HAProxy certificates and measure the effect on TLS traffic."`
 	ServeBackend   ServeBackendCmd   `cmd:"" help:"Serve backend." hidden:"true"`
 	ServeBackends  ServeBackendsCmd  `cmd:"" help:"Serve backends."`
 	Test           TestCmd           `cmd:"" help:"Run client test using requests file."`
@@ -38,17 +45,64 @@ type ProgramCtx struct {
 }
 
 type TestCmd struct {
-	Duration    time.Duration `help:"Test duration" short:"d" default:"60s"`
-	RequestFile string        `help:"Request file." short:"i" type:"existingfile"`
+	ClientCert           string        `help:"Client certificate, with its chain, presented to HAProxy (see gen-proxy-config --mtls)." type:"existingfile"`
+	ClientKey            string        `help:"Key of the client certificate." type:"existingfile"`
+	Duration             time.Duration `help:"Test duration" short:"d" default:"60s"`
+	GRPCMessageSize      int           `name:"grpc-message-size" help:"gRPC message size in bytes." default:"64"`
+	GRPCMethod           string        `name:"grpc-method" help:"gRPC method to call: unary or bidirectional stream." enum:"unary,stream" default:"unary"`
+	GRPCStreamMessages   int           `name:"grpc-stream-messages" help:"Messages echoed per streaming call." default:"100"`
+	Mode                 string        `help:"Traffic to send to each route in the request file." enum:"http,websocket,grpc" default:"http"`
+	RequestFile          string        `help:"Request file." short:"i" type:"existingfile"`
+	WebSocketConnections int           `name:"websocket-connections" help:"Long-lived WebSocket connections per route." default:"1"`
+	WebSocketInterval    time.Duration `name:"websocket-interval" help:"Interval between messages on each WebSocket connection." default:"1s"`
+	WebSocketMessageSize int           `name:"websocket-message-size" help:"WebSocket message size in bytes." default:"64"`
 }
 
 type GenProxyConfigCmd struct {
-	EnableLogging        bool   `default:"true"`
-	ListenAddress        string `default:"::"`
-	Maxconn              int    `default:"0"`
-	Nthreads             int    `default:"4"`
-	StatsPort            int    `default:"1936"`
-	UseUnixDomainSockets bool   `default:"true"`
+	BackendClientCert    bool          `help:"Present a client certificate from the test CA on reencrypt server lines (needed with serve-backends --client-auth)." default:"false"`
+	BalanceEdge          string        `help:"Balance algorithm for edge backends." enum:"roundrobin,leastconn,random,source" default:"random"`
+	BalanceGRPC          string        `help:"Balance algorithm for grpc backends." enum:"roundrobin,leastconn,random,source" default:"random"`
+	BalanceHTTP          string        `help:"Balance algorithm for http backends." enum:"roundrobin,leastconn,random,source" default:"random"`
+	BalancePassthrough   string        `help:"Balance algorithm for passthrough backends." enum:"roundrobin,leastconn,random,source" default:"source"`
+	BalanceReencrypt     string        `help:"Balance algorithm for reencrypt backends." enum:"roundrobin,leastconn,random,source" default:"random"`
+	BackendProto         string        `help:"Protocol HAProxy speaks to edge, http and reencrypt servers (h2 emits proto h2 or alpn h2)." enum:"h1,h2" default:"h1"`
+	EnableLogging        bool          `default:"true"`
+	HealthCheck          bool          `help:"Emit health checks on every server line." default:"false"`
+	HealthCheckFall      int           `help:"Consecutive failed checks before a server is marked down." default:"3"`
+	HealthCheckInterval  time.Duration `help:"Interval between health checks." default:"5s"`
+	HealthCheckPath      string        `help:"Backend health endpoint checked by HTTP backends." default:"/healthz"`
+	HealthCheckRise      int           `help:"Consecutive successful checks before a server is marked up." default:"2"`
+	ListenAddress        string        `default:"::"`
+	Maxconn              int           `default:"0"`
+	MTLS                 string        `name:"mtls" help:"Verify client certificates from the test CA on the fe_sni and public_ssl_sni_only binds (writes certs/clients/client-0.crt for test)." enum:"none,optional,required" default:"none"`
+	Nthreads             int           `default:"4"`
+	OCSP                 bool          `name:"ocsp" help:"Fetch an OCSP response for each certificate from its OCSP responder (see serve-backends --ocsp) and write it to <certificate>.ocsp for HAProxy to staple." default:"false"`
+	PerRouteCerts        bool          `help:"Issue one certificate per edge and reencrypt route from the shared CA instead of sharing one leaf." default:"false"`
+	StatsPort            int           `default:"1936"`
+	UseUnixDomainSockets bool          `default:"true"`
+}
+
+// CertOptions control how certificates are generated. They are set
+// on serve-backends and gen-certs.
+type CertOptions struct {
+	Intermediates int           `help:"Number of intermediate CAs between the root CA and the leaf certificates." default:"0"`
+	KeyType       KeyType       `help:"Key algorithm for new CA and leaf keys." enum:"rsa2048,rsa3072,rsa4096,ecdsa-p256,ecdsa-p384,ed25519" default:"rsa2048"`
+	OCSPURL       string        `name:"ocsp-url" help:"OCSP responder URL put in leaf certificates (default: none, or with serve-backends --ocsp its own /ocsp endpoint)." default:""`
+	RootCA        string        `name:"root-ca" help:"Existing root CA certificate to issue from instead of creating a new root CA each run (requires --root-ca-key)." type:"existingfile"`
+	RootCAKey     string        `name:"root-ca-key" help:"Private key of the root CA given by --root-ca." type:"existingfile"`
+	Validity      time.Duration `help:"Certificate validity period." default:"8760h"`
+}
+
+type GenCertsCmd struct {
+	CertOptions
+
+	Names []string `help:"Additional subject alternate names." default:""`
+}
+
+type GenClientCertsCmd struct {
+	Count    int           `help:"Number of client certificates to issue." default:"1"`
+	KeyType  KeyType       `help:"Key algorithm for the client keys (default: that of the CA)." enum:",rsa2048,rsa3072,rsa4096,ecdsa-p256,ecdsa-p384,ed25519" default:""`
+	Validity time.Duration `help:"Certificate validity period." default:"8760h"`
 }
 
 type GenHostsCmd struct {
@@ -59,14 +113,80 @@ type GenWorkloadCmd struct {
 	UseProxy bool `default:"true"`
 }
 
+// BackendOptions control how each backend responds. They are set on
+// serve-backends and passed through to every spawned serve-backend.
+type BackendOptions struct {
+	Faults
+
+	ChunkDelay     Delay         `help:"Delay between response body chunks (none, fixed:D, uniform:D:JITTER, normal:D:STDDEV)." default:"none"`
+	ChunkSize      int           `help:"Response body chunk size in bytes when a chunk delay is set." default:"256"`
+	ClientAuth     bool          `help:"Reencrypt backends require a client certificate issued by the test CA (see gen-proxy-config --backend-client-cert)." default:"false"`
+	FirstByteDelay Delay         `help:"Delay before the first response byte (none, fixed:D, uniform:D:JITTER, normal:D:STDDEV)." default:"none"`
+	HealthPath     string        `help:"Path of the backend health endpoint." default:"/healthz"`
+	Heartbeat      time.Duration `help:"Interval at which backends tell the metadata server they are alive; backends silent for three intervals are stale (0 disables)." default:"0"`
+	HTTP1Only      bool          `name:"http1-only" help:"Serve HTTP/1.1 only: TLS backends do not offer h2 via ALPN."`
+	HTTP2          bool          `name:"http2" help:"Also serve h2c on cleartext backends; TLS backends offer h2 via ALPN unless --http1-only is set."`
+	WriteTimeout   time.Duration `help:"Backend write timeout; raise it when injecting delays longer than 15s." default:"15s"`
+}
+
 type ServeBackendsCmd struct {
-	ListenAddress string `default:"127.0.0.1"`
+	BackendOptions
+	CertOptions
+
+	ChurnFraction     float64       `help:"Fraction of backend servers restarted on each churn interval." default:"0.1"`
+	ChurnInterval     time.Duration `help:"Restart a share of the backend servers on new ports at this interval (0 disables churn)." default:"0"`
+	Host              string        `help:"Host tag for the backends served here (default: the hostname)." default:""`
+	InProcess         bool          `help:"Run backends as goroutines inside serve-backends instead of one process each." default:"false"`
+	OCSP              bool          `name:"ocsp" help:"Name this server's /ocsp responder in leaf certificates, so that gen-proxy-config --ocsp can fetch responses to staple." default:"false"`
+	ListenAddress     string        `default:"127.0.0.1"`
+	RegisterWith      string        `help:"URL of a central serve-backends to register the backends served here with, instead of being the discovery server; give both the same --heartbeat." default:""`
+	RegisterTimeout   time.Duration `help:"Time allowed for started backends to register (0 derives it from the number of backend servers)." default:"0"`
+	RestartDelay      time.Duration `help:"Time to wait before restarting a backend that died." default:"1s"`
+	RestartPolicy     RestartPolicy `help:"Restart backends that die: never, on-failure or always." enum:"never,on-failure,always" default:"on-failure"`
+	ServersPerBackend int           `help:"Number of server endpoints per backend." default:"1"`
+	SpawnConcurrency  int           `help:"Maximum number of backend servers starting up at once." default:"64"`
 }
 
 type ServeBackendCmd struct {
+	BackendOptions
+
+	Host          string      `default:""`
 	Name          string      `default:""`
 	ListenAddress string      `default:""`
+	Server        int         `default:"0"`
 	TrafficType   TrafficType `default:""`
 }
 
+type PrintCACmd struct{}
+
+type RotateCertsCmd struct {
+	Batch         int           `help:"Certificates rotated per interval, in turn (0 rotates all of them)." default:"0"`
+	Interval      time.Duration `help:"Interval between rotations." default:"30s"`
+	Method        string        `help:"Push certificates through the HAProxy runtime API, or write them and run --reload-command." enum:"runtime-api,reload" default:"runtime-api"`
+	ProbeHost     string        `help:"Route host name probed through HAProxy (default: the first edge route)." default:""`
+	ProbeInterval time.Duration `help:"Interval between TLS probes through HAProxy (0 disables probing)." default:"100ms"`
+	ReloadCommand string        `help:"Command run with sh -c to reload HAProxy when --method=reload." default:""`
+	Socket        string        `help:"HAProxy admin socket (default: <output-dir>/haproxy/haproxy.sock)." default:""`
+}
+
 type VersionCmd struct{}
+
+// args renders the options as serve-backend command line flags.
+func (o BackendOptions) args() []string {
+	return []string{
+		fmt.Sprintf("--chunk-delay=%s", o.ChunkDelay),
+		fmt.Sprintf("--chunk-size=%d", o.ChunkSize),
+		fmt.Sprintf("--client-auth=%v", o.ClientAuth),
+		fmt.Sprintf("--error-rate=%v", o.ErrorRate),
+		fmt.Sprintf("--error-status=%d", o.ErrorStatus),
+		fmt.Sprintf("--first-byte-delay=%s", o.FirstByteDelay),
+		fmt.Sprintf("--hang-rate=%v", o.HangRate),
+		fmt.Sprintf("--health-path=%s", o.HealthPath),
+		fmt.Sprintf("--heartbeat=%s", o.Heartbeat),
+		fmt.Sprintf("--http1-only=%v", o.HTTP1Only),
+		fmt.Sprintf("--http2=%v", o.HTTP2),
+		fmt.Sprintf("--reset-rate=%v", o.ResetRate),
+		fmt.Sprintf("--truncate-rate=%v", o.TruncateRate),
+		fmt.Sprintf("--write-timeout=%s", o.WriteTimeout),
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Backends serve their control endpoints under this prefix on the
+// same listener as the test traffic.
+const controlPathPrefix = "/_hydra/"
+
+// newControlClient returns a client that can talk to every backend,
+// trusting the root CA that signed the backend certificates. It
+// presents the backend leaf, which is also valid for client auth, to
+// backends that require a client certificate.
+func newControlClient(certBundle *Certificates) *http.Client {
+	certPool := x509.NewCertPool()
+	certPool.AppendCertsFromPEM([]byte(certBundle.RootCACertPEM))
+
+	tlsConfig := &tls.Config{
+		RootCAs: certPool,
+	}
+
+	if cert, err := tls.X509KeyPair([]byte(certBundle.LeafCertPEM+certBundle.IntermediateCertsPEM), []byte(certBundle.LeafKeyPEM)); err == nil {
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: tlsConfig,
+		},
+	}
+}
+
+// controlRequest sends method and body to the control endpoint
+// endpoint of backend b and returns the response body.
+func controlRequest(client *http.Client, b BoundBackend, method, endpoint string, body []byte) ([]byte, error) {
+	url := fmt.Sprintf("%s://%s:%d%s%s", directSchemeSelector(b.TrafficType), b.ListenAddress, b.Port, controlPathPrefix, endpoint)
+
+	request, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json; charset=UTF-8")
+
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer func(Body io.ReadCloser) { _ = Body.Close() }(resp.Body)
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %v: %s", method, url, resp.Status, bytes.TrimSpace(data))
+	}
+	return data, nil
+}
+
+// controlResult is the per-backend outcome of a control request
+// fanned out by the metadata server.
+type controlResult struct {
+	Response json.RawMessage `json:"response,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// broadcastControlRequest sends the same control request to each
+// backend, at most 64 at a time.
+func broadcastControlRequest(client *http.Client, backends []BoundBackend, method, endpoint string, body []byte) map[string]controlResult {
+	var (
+		g       errgroup.Group
+		lock    sync.Mutex
+		results = map[string]controlResult{}
+	)
+
+	g.SetLimit(64)
+
+	for i := range backends {
+		b := backends[i]
+		g.Go(func() error {
+			var result controlResult
+			if data, err := controlRequest(client, b, method, endpoint, body); err != nil {
+				result.Error = err.Error()
+			} else {
+				result.Response = data
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			results[b.ID()] = result
+			return nil
+		})
+	}
+
+	_ = g.Wait()
+	return results
+}
+
+// selectBackends returns the backends matching the "name" and
+// "traffic-type" query parameters; no parameters selects them all.
+func selectBackends(r *http.Request, backends []BoundBackend) []BoundBackend {
+	query := r.URL.Query()
+	names := query["name"]
+	trafficTypes := query["traffic-type"]
+
+	contains := func(values []string, s string) bool {
+		for _, v := range values {
+			if v == s {
+				return true
+			}
+		}
+		return false
+	}
+
+	var result []BoundBackend
+	for _, b := range backends {
+		if len(names) > 0 && !contains(names, b.Name) {
+			continue
+		}
+		if len(trafficTypes) > 0 && !contains(trafficTypes, string(b.TrafficType)) {
+			continue
+		}
+		result = append(result, b)
+	}
+	return result
+}
+
+// controlBroadcastHandler forwards GET, PUT and POST requests to the
+// endpoint control endpoint of the backends selected by the request
+// and responds with the result from each one.
+func controlBroadcastHandler(client *http.Client, registry *backendRegistry, endpoint string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body []byte
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			var err error
+			if body, err = io.ReadAll(r.Body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, r.Method, http.StatusMethodNotAllowed)
+			return
+		}
+		results := broadcastControlRequest(client, selectBackends(r, registry.Bound()), r.Method, endpoint, body)
+		data, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := io.WriteString(w, string(data)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type DelayDistribution string
+
+const (
+	NoDelay      DelayDistribution = "none"
+	FixedDelay   DelayDistribution = "fixed"
+	UniformDelay DelayDistribution = "uniform"
+	NormalDelay  DelayDistribution = "normal"
+)
+
+// Delay describes how long a backend waits before responding or
+// between chunks of a response body. The string form is one of:
+//
+//	none
+//	fixed:DURATION
+//	uniform:DURATION:JITTER  (DURATION +/- JITTER)
+//	normal:DURATION:STDDEV   (mean DURATION, standard deviation STDDEV)
+type Delay struct {
+	Distribution DelayDistribution
+	Duration     time.Duration
+	Jitter       time.Duration
+}
+
+func parseDelay(s string) (Delay, error) {
+	fields := strings.Split(s, ":")
+
+	parseDurations := func(values []string) ([]time.Duration, error) {
+		var durations []time.Duration
+		for _, v := range values {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid delay %q: %v", s, err)
+			}
+			if d < 0 {
+				return nil, fmt.Errorf("invalid delay %q: negative duration", s)
+			}
+			durations = append(durations, d)
+		}
+		return durations, nil
+	}
+
+	switch DelayDistribution(fields[0]) {
+	case "", NoDelay:
+		if len(fields) > 1 {
+			return Delay{}, fmt.Errorf("invalid delay %q: none takes no arguments", s)
+		}
+		return Delay{Distribution: NoDelay}, nil
+	case FixedDelay:
+		if len(fields) != 2 {
+			return Delay{}, fmt.Errorf("invalid delay %q: expected fixed:DURATION", s)
+		}
+		d, err := parseDurations(fields[1:])
+		if err != nil {
+			return Delay{}, err
+		}
+		return Delay{Distribution: FixedDelay, Duration: d[0]}, nil
+	case UniformDelay, NormalDelay:
+		if len(fields) != 3 {
+			return Delay{}, fmt.Errorf("invalid delay %q: expected %s:DURATION:JITTER", s, fields[0])
+		}
+		d, err := parseDurations(fields[1:])
+		if err != nil {
+			return Delay{}, err
+		}
+		return Delay{Distribution: DelayDistribution(fields[0]), Duration: d[0], Jitter: d[1]}, nil
+	}
+
+	return Delay{}, fmt.Errorf("invalid delay %q: unknown distribution %q", s, fields[0])
+}
+
+func (d *Delay) UnmarshalText(text []byte) error {
+	delay, err := parseDelay(string(text))
+	if err != nil {
+		return err
+	}
+	*d = delay
+	return nil
+}
+
+func (d Delay) String() string {
+	switch d.Distribution {
+	case FixedDelay:
+		return fmt.Sprintf("%s:%s", d.Distribution, d.Duration)
+	case UniformDelay, NormalDelay:
+		return fmt.Sprintf("%s:%s:%s", d.Distribution, d.Duration, d.Jitter)
+	default:
+		return string(NoDelay)
+	}
+}
+
+func (d Delay) Enabled() bool {
+	return d.Distribution != "" && d.Distribution != NoDelay
+}
+
+// Sample returns the next delay drawn from the distribution. It
+// never returns a negative duration.
+func (d Delay) Sample() time.Duration {
+	var delay float64
+
+	switch d.Distribution {
+	case FixedDelay:
+		delay = float64(d.Duration)
+	case UniformDelay:
+		delay = float64(d.Duration) + (2*rand.Float64()-1)*float64(d.Jitter)
+	case NormalDelay:
+		delay = float64(d.Duration) + rand.NormFloat64()*float64(d.Jitter)
+	default:
+		return 0
+	}
+
+	return time.Duration(math.Max(0, delay))
+}
+
+// sleepContext sleeps for d or until ctx is done, whichever happens
+// first. It reports whether the full duration elapsed.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// slowWriter splits the response body into chunkSize writes, flushing
+// and pausing between each one so that the body trickles out.
+type slowWriter struct {
+	http.ResponseWriter
+
+	chunkDelay Delay
+	chunkSize  int
+	request    *http.Request
+	started    bool
+}
+
+func (w *slowWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		if w.started && !sleepContext(w.request.Context(), w.chunkDelay.Sample()) {
+			return written, w.request.Context().Err()
+		}
+		w.started = true
+		n := w.chunkSize
+		if n > len(data) {
+			n = len(data)
+		}
+		m, err := w.ResponseWriter.Write(data[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		if f, ok := w.ResponseWriter.(http.Flusher); ok {
+			f.Flush()
+		}
+		data = data[n:]
+	}
+	return written, nil
+}
+
+// delayHandler injects time-to-first-byte and body streaming delays.
+// The backend defaults can be overridden per request with the
+// "delay", "chunk-delay" and "chunk-size" query parameters.
+func delayHandler(opts BackendOptions, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		firstByteDelay := opts.FirstByteDelay
+		chunkDelay := opts.ChunkDelay
+		chunkSize := opts.ChunkSize
+
+		query := r.URL.Query()
+		if v := query.Get("delay"); v != "" {
+			d, err := parseDelay(v)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			firstByteDelay = d
+		}
+		if v := query.Get("chunk-delay"); v != "" {
+			d, err := parseDelay(v)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			chunkDelay = d
+		}
+		if v := query.Get("chunk-size"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				http.Error(w, fmt.Sprintf("invalid chunk-size %q", v), http.StatusBadRequest)
+				return
+			}
+			chunkSize = n
+		}
+
+		if !sleepContext(r.Context(), firstByteDelay.Sample()) {
+			return
+		}
+
+		if chunkDelay.Enabled() && chunkSize > 0 {
+			w = &slowWriter{
+				ResponseWriter: w,
+				chunkDelay:     chunkDelay,
+				chunkSize:      chunkSize,
+				request:        r,
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
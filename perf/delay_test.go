@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDelay(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected Delay
+		invalid  bool
+	}{
+		{input: "", expected: Delay{Distribution: NoDelay}},
+		{input: "none", expected: Delay{Distribution: NoDelay}},
+		{input: "fixed:100ms", expected: Delay{Distribution: FixedDelay, Duration: 100 * time.Millisecond}},
+		{input: "uniform:1s:250ms", expected: Delay{Distribution: UniformDelay, Duration: time.Second, Jitter: 250 * time.Millisecond}},
+		{input: "normal:50ms:5ms", expected: Delay{Distribution: NormalDelay, Duration: 50 * time.Millisecond, Jitter: 5 * time.Millisecond}},
+		{input: "fixed", invalid: true},
+		{input: "fixed:-1s", invalid: true},
+		{input: "normal:50ms", invalid: true},
+		{input: "none:1s", invalid: true},
+		{input: "exponential:1s", invalid: true},
+	} {
+		d, err := parseDelay(tc.input)
+		if tc.invalid {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %+v", tc.input, d)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.input, err)
+			continue
+		}
+		if d != tc.expected {
+			t.Errorf("%q: expected %+v, got %+v", tc.input, tc.expected, d)
+		}
+		if roundTrip, err := parseDelay(d.String()); err != nil || roundTrip != d {
+			t.Errorf("%q: String() did not round trip: %q", tc.input, d.String())
+		}
+	}
+}
+
+func TestDelaySampleIsNeverNegative(t *testing.T) {
+	d := Delay{Distribution: NormalDelay, Duration: time.Millisecond, Jitter: time.Second}
+	for i := 0; i < 1000; i++ {
+		if s := d.Sample(); s < 0 {
+			t.Fatalf("negative sample: %v", s)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// Faults are the failure modes a backend injects. Each rate is the
+// probability, between 0 and 1, that a request fails that way; a
+// request fails in at most one way so the rates must not add up to
+// more than 1.
+type Faults struct {
+	ErrorRate    float64 `json:"error_rate" help:"Probability of answering with --error-status." default:"0"`
+	ErrorStatus  int     `json:"error_status" help:"HTTP status returned for injected errors." default:"503"`
+	HangRate     float64 `json:"hang_rate" help:"Probability of never answering a request." default:"0"`
+	ResetRate    float64 `json:"reset_rate" help:"Probability of closing the connection with a TCP RST." default:"0"`
+	TruncateRate float64 `json:"truncate_rate" help:"Probability of cutting off the response body half way." default:"0"`
+}
+
+func (f Faults) Validate() error {
+	total := 0.0
+	for _, rate := range []struct {
+		name  string
+		value float64
+	}{
+		{"error-rate", f.ErrorRate},
+		{"hang-rate", f.HangRate},
+		{"reset-rate", f.ResetRate},
+		{"truncate-rate", f.TruncateRate},
+	} {
+		if rate.value < 0 || rate.value > 1 {
+			return fmt.Errorf("%s %v: must be between 0 and 1", rate.name, rate.value)
+		}
+		total += rate.value
+	}
+	if total > 1 {
+		return fmt.Errorf("fault rates add up to %v; must not exceed 1", total)
+	}
+	if f.ErrorStatus < 500 || f.ErrorStatus > 599 {
+		return fmt.Errorf("error-status %v: must be a 5xx status", f.ErrorStatus)
+	}
+	return nil
+}
+
+type faultInjector struct {
+	sync.RWMutex
+	faults Faults
+}
+
+func (i *faultInjector) Get() Faults {
+	i.RLock()
+	defer i.RUnlock()
+	return i.faults
+}
+
+func (i *faultInjector) Set(f Faults) error {
+	if err := f.Validate(); err != nil {
+		return err
+	}
+	i.Lock()
+	defer i.Unlock()
+	i.faults = f
+	return nil
+}
+
+// truncatingWriter aborts the connection half way through the body,
+// leaving the client short of Content-Length.
+type truncatingWriter struct {
+	http.ResponseWriter
+
+	limit int
+}
+
+func (w *truncatingWriter) Write(data []byte) (int, error) {
+	if w.limit < 0 {
+		w.limit = len(data) / 2
+		if n, err := strconv.Atoi(w.Header().Get("Content-Length")); err == nil {
+			w.limit = n / 2
+		}
+	}
+	if len(data) <= w.limit {
+		n, err := w.ResponseWriter.Write(data)
+		w.limit -= n
+		return n, err
+	}
+	n, _ := w.ResponseWriter.Write(data[:w.limit])
+	w.limit -= n
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+	panic(http.ErrAbortHandler)
+}
+
+// Flush passes through so that a chunk delay still trickles out the
+// part of the body that is written.
+func (w *truncatingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// resetConnection closes the client connection with SO_LINGER set to
+// zero so that the peer sees a TCP RST rather than a FIN. It never
+// returns; the handler is aborted so that the request is counted as
+// failed.
+func resetConnection(w http.ResponseWriter) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		panic(http.ErrAbortHandler)
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	netConn := conn
+	if tlsConn, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		netConn = tlsConn.NetConn()
+	}
+	if tcpConn, ok := netConn.(*net.TCPConn); ok {
+		_ = tcpConn.SetLinger(0)
+	}
+	_ = netConn.Close()
+	panic(http.ErrAbortHandler)
+}
+
+func (i *faultInjector) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f := i.Get()
+		x := rand.Float64()
+
+		switch {
+		case x < f.ResetRate:
+			resetConnection(w)
+		case x < f.ResetRate+f.HangRate:
+			// Hold the request until the client gives up, then
+			// abort it so that it is counted as failed.
+			<-r.Context().Done()
+			panic(http.ErrAbortHandler)
+		case x < f.ResetRate+f.HangRate+f.ErrorRate:
+			http.Error(w, http.StatusText(f.ErrorStatus), f.ErrorStatus)
+		case x < f.ResetRate+f.HangRate+f.ErrorRate+f.TruncateRate:
+			next.ServeHTTP(&truncatingWriter{ResponseWriter: w, limit: -1}, r)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// ServeHTTP implements the backend's /_hydra/faults control
+// endpoint: GET returns the current faults, PUT or POST replaces
+// them.
+func (i *faultInjector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		f := i.Get()
+		if err := decoder.Decode(&f); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := i.Set(f); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, r.Method, http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := json.Marshal(i.Get())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
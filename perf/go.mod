@@ -4,4 +4,9 @@ go 1.19
 
 require github.com/alecthomas/kong v0.7.0
 
-require golang.org/x/sync v0.1.0
+require (
+	golang.org/x/net v0.34.0
+	golang.org/x/sync v0.10.0
+)
+
+require golang.org/x/text v0.21.0 // indirect
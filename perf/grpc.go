@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// The backends implement a tiny gRPC echo service directly on top of
+// HTTP/2. Messages are opaque bytes, so no protobuf code is needed;
+// only the gRPC length-prefixed framing and status trailers are.
+const (
+	grpcServicePrefix = "/hydra.Echo/"
+	grpcUnaryPath     = grpcServicePrefix + "Unary"
+	grpcStreamPath    = grpcServicePrefix + "Stream"
+)
+
+// gRPC status codes used by the echo service and client.
+const (
+	grpcOK            = 0
+	grpcUnknown       = 2
+	grpcInternal      = 13
+	grpcUnimplemented = 12
+	grpcUnavailable   = 14
+)
+
+var grpcStatusNames = []string{
+	"OK", "CANCELLED", "UNKNOWN", "INVALID_ARGUMENT", "DEADLINE_EXCEEDED",
+	"NOT_FOUND", "ALREADY_EXISTS", "PERMISSION_DENIED", "RESOURCE_EXHAUSTED",
+	"FAILED_PRECONDITION", "ABORTED", "OUT_OF_RANGE", "UNIMPLEMENTED",
+	"INTERNAL", "UNAVAILABLE", "DATA_LOSS", "UNAUTHENTICATED",
+}
+
+func grpcStatusName(code int) string {
+	if code >= 0 && code < len(grpcStatusNames) {
+		return grpcStatusNames[code]
+	}
+	return fmt.Sprintf("CODE_%d", code)
+}
+
+// grpcStatusFromHTTP maps an HTTP status without gRPC trailers, for
+// example an HAProxy error page, to a gRPC status as described in
+// the gRPC HTTP/2 protocol specification.
+func grpcStatusFromHTTP(status int) int {
+	switch status {
+	case http.StatusBadRequest:
+		return grpcInternal
+	case http.StatusUnauthorized:
+		return 16
+	case http.StatusForbidden:
+		return 7
+	case http.StatusNotFound:
+		return grpcUnimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return grpcUnavailable
+	}
+	return grpcUnknown
+}
+
+func writeGRPCMessage(w io.Writer, msg []byte) error {
+	var prefix [5]byte
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+	if _, err := w.Write(prefix[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(msg)
+	return err
+}
+
+// readGRPCMessage returns io.EOF when r ends cleanly between messages.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, errors.New("compressed gRPC messages are not supported")
+	}
+	msg := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+// grpcEchoHandler serves the Unary and bidirectional Stream methods,
+// echoing every request message back.
+func grpcEchoHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			http.Error(w, "gRPC requests only", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+
+		status, message := grpcOK, ""
+
+		switch r.URL.Path {
+		case grpcUnaryPath, grpcStreamPath:
+			for {
+				msg, err := readGRPCMessage(r.Body)
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					status, message = grpcInternal, err.Error()
+					break
+				}
+				if err := writeGRPCMessage(w, msg); err != nil {
+					return
+				}
+				if f, ok := w.(http.Flusher); ok {
+					f.Flush()
+				}
+				if r.URL.Path == grpcUnaryPath {
+					break
+				}
+			}
+		default:
+			status, message = grpcUnimplemented, "unknown method "+r.URL.Path
+		}
+
+		w.Header().Set("Grpc-Status", strconv.Itoa(status))
+		w.Header().Set("Grpc-Message", message)
+	})
+}
+
+// newGRPCClient returns an HTTP/2-only client for scheme: h2c with
+// prior knowledge for http and h2 via ALPN for https.
+func newGRPCClient(scheme string, tlsConfig *tls.Config) *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	transport := &http2.Transport{
+		TLSClientConfig: tlsConfig.Clone(),
+	}
+	if scheme == "http" {
+		transport.AllowHTTP = true
+		transport.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+	return &http.Client{Transport: transport}
+}
+
+type grpcResults struct {
+	lock            sync.Mutex
+	statuses        map[int]uint64
+	messages        atomic.Uint64
+	transportErrors atomic.Uint64
+}
+
+func (r *grpcResults) recordStatus(code int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.statuses[code] += 1
+}
+
+func (r *grpcResults) String() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var codes []int
+	var calls uint64
+	for code, n := range r.statuses {
+		codes = append(codes, code)
+		calls += n
+	}
+	sort.Ints(codes)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "calls: %v messages: %v transport-errors: %v", calls, r.messages.Load(), r.transportErrors.Load())
+	for _, code := range codes {
+		fmt.Fprintf(&b, " %s: %v", grpcStatusName(code), r.statuses[code])
+	}
+	return b.String()
+}
+
+// grpcCall makes one call and returns its gRPC status. An error is
+// only returned when no status could be determined at all.
+func (c *TestCmd) grpcCall(ctx context.Context, client *http.Client, url string, payload []byte, results *grpcResults) (int, error) {
+	messages := 1
+	path := grpcUnaryPath
+	if c.GRPCMethod == "stream" {
+		messages = c.GRPCStreamMessages
+		path = grpcStreamPath
+	}
+
+	bodyReader, bodyWriter := io.Pipe()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url+path, bodyReader)
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/grpc")
+	request.Header.Set("TE", "trailers")
+
+	// Send the first message before the request starts so that
+	// unary calls go out in a single round trip.
+	go func() {
+		_ = writeGRPCMessage(bodyWriter, payload)
+		if messages == 1 {
+			_ = bodyWriter.Close()
+		}
+	}()
+
+	resp, err := client.Do(request)
+	if err != nil {
+		_ = bodyWriter.CloseWithError(err)
+		return 0, err
+	}
+	defer func(Body io.ReadCloser) { _ = Body.Close() }(resp.Body)
+
+	for i := 0; i < messages; i++ {
+		echo, err := readGRPCMessage(resp.Body)
+		if err != nil {
+			break
+		}
+		if !bytes.Equal(echo, payload) {
+			_ = bodyWriter.CloseWithError(errors.New("corrupt echo"))
+			return grpcInternal, nil
+		}
+		results.messages.Add(1)
+		if i+1 == messages {
+			break
+		}
+		if err := writeGRPCMessage(bodyWriter, payload); err != nil {
+			break
+		}
+	}
+	_ = bodyWriter.Close()
+
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return 0, err
+	}
+
+	for _, status := range []string{resp.Trailer.Get("Grpc-Status"), resp.Header.Get("Grpc-Status")} {
+		if status != "" {
+			code, err := strconv.Atoi(status)
+			if err != nil {
+				return grpcUnknown, nil
+			}
+			return code, nil
+		}
+	}
+
+	return grpcStatusFromHTTP(resp.StatusCode), nil
+}
+
+func (c *TestCmd) runGRPC(p *ProgramCtx, requests []MBRequest, tlsConfig *tls.Config) error {
+	if c.GRPCMessageSize < 0 || c.GRPCStreamMessages < 1 {
+		return fmt.Errorf("--grpc-message-size must not be negative and --grpc-stream-messages must be positive")
+	}
+
+	ctx, cancel := context.WithTimeout(p.Context, c.Duration)
+	defer cancel()
+
+	var (
+		results = grpcResults{statuses: map[int]uint64{}}
+		wg      sync.WaitGroup
+		payload = bytes.Repeat([]byte("x"), c.GRPCMessageSize)
+	)
+
+	for _, request := range requests {
+		request := request
+		url := fmt.Sprintf("%v://%v:%v", request.Scheme, request.Host, testPort(p, request.Scheme))
+		for i := 0; i < request.Clients; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				client := newGRPCClient(request.Scheme, tlsConfig)
+				for ctx.Err() == nil {
+					code, err := c.grpcCall(ctx, client, url, payload, &results)
+					switch {
+					case ctx.Err() != nil:
+					case err != nil:
+						results.transportErrors.Add(1)
+						log.Printf("%s: %v", url, err)
+					default:
+						results.recordStatus(code)
+					}
+				}
+			}()
+		}
+	}
+
+	progressTicker := time.NewTicker(1 * time.Second)
+	defer progressTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			log.Println(results.String())
+			if p.Context.Err() != nil {
+				return errors.New("test interrupted")
+			}
+			return nil
+		case <-progressTicker.C:
+			log.Println(results.String())
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestGRPCMessageFraming(t *testing.T) {
+	var buf bytes.Buffer
+	for _, msg := range [][]byte{[]byte("hello"), {}, bytes.Repeat([]byte("x"), 70000)} {
+		if err := writeGRPCMessage(&buf, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, expected := range []int{5, 0, 70000} {
+		msg, err := readGRPCMessage(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msg) != expected {
+			t.Errorf("expected a %d byte message, got %d", expected, len(msg))
+		}
+	}
+
+	if _, err := readGRPCMessage(&buf); !errors.Is(err, io.EOF) {
+		t.Errorf("expected io.EOF between messages, got %v", err)
+	}
+
+	if _, err := readGRPCMessage(bytes.NewReader([]byte{0, 0, 0, 0, 4, 'a'})); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected io.ErrUnexpectedEOF for a short message, got %v", err)
+	}
+
+	if _, err := readGRPCMessage(bytes.NewReader([]byte{1, 0, 0, 0, 0})); err == nil {
+		t.Error("expected an error for a compressed message")
+	}
+}
+
+func TestGRPCEchoRoundTrip(t *testing.T) {
+	server := httptest.NewServer(h2c.NewHandler(grpcEchoHandler(), &http2.Server{}))
+	defer server.Close()
+
+	client := newGRPCClient("http", nil)
+	payload := []byte("ping")
+
+	for _, tc := range []struct {
+		method   string
+		messages int
+	}{
+		{method: "unary", messages: 1},
+		{method: "stream", messages: 10},
+	} {
+		cmd := &TestCmd{GRPCMethod: tc.method, GRPCStreamMessages: tc.messages}
+		results := &grpcResults{statuses: map[int]uint64{}}
+
+		code, err := cmd.grpcCall(context.Background(), client, server.URL, payload, results)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.method, err)
+		}
+		if code != grpcOK {
+			t.Errorf("%s: expected status OK, got %s", tc.method, grpcStatusName(code))
+		}
+		if n := results.messages.Load(); n != uint64(tc.messages) {
+			t.Errorf("%s: expected %d echoed message(s), got %d", tc.method, tc.messages, n)
+		}
+	}
+}
+
+func TestGRPCEchoUnknownMethod(t *testing.T) {
+	server := httptest.NewServer(h2c.NewHandler(grpcEchoHandler(), &http2.Server{}))
+	defer server.Close()
+
+	var body bytes.Buffer
+	if err := writeGRPCMessage(&body, []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := http.NewRequest(http.MethodPost, server.URL+grpcServicePrefix+"Missing", &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Content-Type", "application/grpc")
+
+	resp, err := newGRPCClient("http", nil).Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(Body io.ReadCloser) { _ = Body.Close() }(resp.Body)
+
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := resp.Trailer.Get("Grpc-Status"); status != "12" {
+		t.Errorf("expected trailer Grpc-Status 12 (UNIMPLEMENTED), got %q", status)
+	}
+}
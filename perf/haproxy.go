@@ -9,11 +9,14 @@ import (
 	"math/rand"
 	"os"
 	"path"
+	"time"
 )
 
 type HAProxyGlobalConfig struct {
 	Backends             []HAProxyBackendConfig
 	Certificate          string
+	ClientCAFile         string
+	ClientVerify         string
 	EnableLogging        bool
 	HTTPPort             int
 	HTTPSPort            int
@@ -27,16 +30,31 @@ type HAProxyGlobalConfig struct {
 }
 
 type HAProxyBackendConfig struct {
+	Balance       string
 	BackendCookie string
-	ListenAddress string
+	ClientCert    string
+	HealthCheck   *HAProxyHealthCheckConfig
 	Name          string
 	OutputDir     string
-	Port          string
-	ServerCookie  string
+	Proto         string
+	Servers       []HAProxyServerConfig
 	TLSCACert     string
 	TrafficType   TrafficType
 }
 
+type HAProxyHealthCheckConfig struct {
+	Fall     int
+	Interval string
+	Path     string
+	Rise     int
+}
+
+type HAProxyServerConfig struct {
+	Cookie        string
+	ListenAddress string
+	Port          string
+}
+
 const (
 	HTTPBackendMapName      = "os_http_be.map"
 	ReencryptBackendMapName = "os_edge_reencrypt_be.map"
@@ -84,12 +102,21 @@ func filterBackendsByType(types []TrafficType, backends []HAProxyBackendConfig)
 }
 
 func (c *GenProxyConfigCmd) Run(p *ProgramCtx) error {
-	backendsByTrafficType, err := fetchAllBackendMetadata(p.DiscoveryURL)
+	if c.HealthCheck {
+		if err := validateHealthPath(c.HealthCheckPath); err != nil {
+			return err
+		}
+		if c.HealthCheckInterval < time.Millisecond || c.HealthCheckRise < 1 || c.HealthCheckFall < 1 {
+			return fmt.Errorf("health check interval, rise and fall must be positive")
+		}
+	}
+
+	backendsByTrafficType, err := backendMetadata(p)
 	if err != nil {
 		return err
 	}
 
-	certBundle, err := fetchCertficates(p.DiscoveryURL)
+	certBundle, err := certificates(p)
 	if err != nil {
 		return err
 	}
@@ -99,19 +126,55 @@ func (c *GenProxyConfigCmd) Run(p *ProgramCtx) error {
 		return err
 	}
 
+	haproxyDir := haproxyCertDir(p.OutputDir)
+	if err := os.RemoveAll(haproxyDir); err != nil {
+		return err
+	}
+
+	haproxyCertFile := certStore(haproxyDir).DomainFile
+	if err := createFile(haproxyCertFile, []byte(domainPEM(certBundle))); err != nil {
+		return err
+	}
+
+	// HAProxy presents this to reencrypt backends that require a
+	// client certificate.
+	var backendClientCert string
+
+	if c.BackendClientCert {
+		clientDir := path.Join(p.OutputDir, "certs", "clients")
+		if _, err := writeClientCertificates(clientDir, certBundle, "", 365*24*time.Hour, "haproxy"); err != nil {
+			return err
+		}
+		backendClientCert = path.Join(clientDir, "haproxy.pem")
+	}
+
 	var proxyBackends []HAProxyBackendConfig
 
 	for t, backends := range backendsByTrafficType {
+		// Group the servers of each route into a single backend,
+		// preserving the order in which routes were listed.
+		index := map[string]int{}
 		for _, b := range backends {
-			proxyBackends = append(proxyBackends, HAProxyBackendConfig{
-				BackendCookie: cookie(),
+			i, ok := index[b.Name]
+			if !ok {
+				i = len(proxyBackends)
+				index[b.Name] = i
+				proxyBackends = append(proxyBackends, HAProxyBackendConfig{
+					Balance:       c.balanceAlgorithm(t),
+					BackendCookie: cookie(),
+					ClientCert:    backendClientCert,
+					HealthCheck:   c.healthCheck(),
+					Name:          b.Name,
+					OutputDir:     p.OutputDir,
+					Proto:         c.BackendProto,
+					TLSCACert:     certPaths.RootCAFile,
+					TrafficType:   t,
+				})
+			}
+			proxyBackends[i].Servers = append(proxyBackends[i].Servers, HAProxyServerConfig{
+				Cookie:        cookie(),
 				ListenAddress: b.ListenAddress,
-				Name:          b.Name,
-				OutputDir:     p.OutputDir,
 				Port:          fmt.Sprintf("%v", b.Port),
-				ServerCookie:  cookie(),
-				TLSCACert:     certPaths.RootCAFile,
-				TrafficType:   t,
 			})
 		}
 	}
@@ -129,7 +192,7 @@ func (c *GenProxyConfigCmd) Run(p *ProgramCtx) error {
 		}
 	}
 
-	if err := c.generateMainConfig(p, proxyBackends, certPaths.DomainFile); err != nil {
+	if err := c.generateMainConfig(p, proxyBackends, haproxyCertFile, certPaths.RootCAFile); err != nil {
 		return err
 	}
 
@@ -137,17 +200,71 @@ func (c *GenProxyConfigCmd) Run(p *ProgramCtx) error {
 		return err
 	}
 
-	if err := c.generateCertConfig(p, proxyBackends, certPaths.DomainFile); err != nil {
+	if err := c.generateCertConfig(p, proxyBackends, certBundle, haproxyCertFile); err != nil {
 		return err
 	}
 
+	// The certs directory was just rewritten; issue a client
+	// certificate for test to present.
+	if c.MTLS != "none" {
+		if _, err := writeClientCertificates(path.Join(p.OutputDir, "certs", "clients"), certBundle, "", 365*24*time.Hour, "client-0"); err != nil {
+			return err
+		}
+	}
+
+	if c.OCSP {
+		files, err := haproxyCertificateFiles(haproxyDir)
+		if err != nil {
+			return err
+		}
+		if err := writeOCSPResponses(files); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (c *GenProxyConfigCmd) generateMainConfig(p *ProgramCtx, backends []HAProxyBackendConfig, certFile string) error {
+// haproxyCertDir is where gen-proxy-config writes the certificates
+// HAProxy serves. They are kept apart from the backends' own so that
+// rotate-certs can replace them without affecting the backends.
+func haproxyCertDir(outputDir string) string {
+	return path.Join(outputDir, "certs", "haproxy")
+}
+
+func (c *GenProxyConfigCmd) balanceAlgorithm(t TrafficType) string {
+	switch t {
+	case EdgeTraffic:
+		return c.BalanceEdge
+	case GRPCTraffic:
+		return c.BalanceGRPC
+	case HTTPTraffic:
+		return c.BalanceHTTP
+	case PassthroughTraffic:
+		return c.BalancePassthrough
+	case ReencryptTraffic:
+		return c.BalanceReencrypt
+	}
+	panic("unexpected traffic type: " + t)
+}
+
+func (c *GenProxyConfigCmd) healthCheck() *HAProxyHealthCheckConfig {
+	if !c.HealthCheck {
+		return nil
+	}
+	return &HAProxyHealthCheckConfig{
+		Fall:     c.HealthCheckFall,
+		Interval: fmt.Sprintf("%dms", c.HealthCheckInterval.Milliseconds()),
+		Path:     c.HealthCheckPath,
+		Rise:     c.HealthCheckRise,
+	}
+}
+
+func (c *GenProxyConfigCmd) generateMainConfig(p *ProgramCtx, backends []HAProxyBackendConfig, certFile, clientCAFile string) error {
 	config := HAProxyGlobalConfig{
 		Backends:             backends,
 		Certificate:          certFile,
+		ClientCAFile:         clientCAFile,
 		EnableLogging:        c.EnableLogging,
 		HTTPPort:             p.HTTPPort,
 		HTTPSPort:            p.HTTPSPort,
@@ -160,6 +277,10 @@ func (c *GenProxyConfigCmd) generateMainConfig(p *ProgramCtx, backends []HAProxy
 		UseUnixDomainSockets: c.UseUnixDomainSockets,
 	}
 
+	if c.MTLS != "none" {
+		config.ClientVerify = c.MTLS
+	}
+
 	var haproxyConf bytes.Buffer
 
 	for _, tmpl := range []*template.Template{
@@ -193,12 +314,14 @@ func (c *GenProxyConfigCmd) generateMapFiles(p *ProgramCtx, backends []HAProxyBa
 		Buffer       *bytes.Buffer
 	}{{
 		MapName:      HTTPBackendMapName,
-		TrafficTypes: []TrafficType{HTTPTraffic},
+		TrafficTypes: []TrafficType{HTTPTraffic, GRPCTraffic},
 		Buffer:       &bytes.Buffer{},
 		MapEntry: func(b HAProxyBackendConfig) string {
 			switch b.TrafficType {
 			case HTTPTraffic:
 				return fmt.Sprintf("^%s\\.?(:[0-9]+)?(/.*)?$ be_http:%s\n", b.Name, b.Name)
+			case GRPCTraffic:
+				return fmt.Sprintf("^%s\\.?(:[0-9]+)?(/.*)?$ be_grpc:%s\n", b.Name, b.Name)
 			default:
 				panic("unexpected traffic type: " + b.TrafficType)
 			}
@@ -265,11 +388,34 @@ func (c *GenProxyConfigCmd) generateMapFiles(p *ProgramCtx, backends []HAProxyBa
 	return nil
 }
 
-func (c *GenProxyConfigCmd) generateCertConfig(p *ProgramCtx, backends []HAProxyBackendConfig, certFile string) error {
+// generateCertConfig writes the crt-list used by the TLS terminating
+// frontends. By default every edge and reencrypt route uses certFile;
+// with --per-route-certs each gets its own leaf certificate, issued
+// from the shared CA, as a real router would load them.
+func (c *GenProxyConfigCmd) generateCertConfig(p *ProgramCtx, backends []HAProxyBackendConfig, certBundle *Certificates, certFile string) error {
 	var certConfigMap bytes.Buffer
 
-	for _, b := range filterBackendsByType([]TrafficType{EdgeTraffic, ReencryptTraffic}, backends) {
-		if _, err := io.WriteString(&certConfigMap, fmt.Sprintf("%s %s\n", certFile, b.Name)); err != nil {
+	routes := filterBackendsByType([]TrafficType{EdgeTraffic, ReencryptTraffic}, backends)
+
+	routeCertFiles := map[string]string{}
+
+	if c.PerRouteCerts {
+		var names []string
+		for _, b := range routes {
+			names = append(names, b.Name)
+		}
+		var err error
+		if routeCertFiles, err = writeRouteCertificates(path.Join(path.Dir(certFile), "routes"), certBundle, names); err != nil {
+			return err
+		}
+	}
+
+	for _, b := range routes {
+		routeCertFile, ok := routeCertFiles[b.Name]
+		if !ok {
+			routeCertFile = certFile
+		}
+		if _, err := io.WriteString(&certConfigMap, fmt.Sprintf("%s %s\n", routeCertFile, b.Name)); err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// BackendHealth is the state reported by a backend's health
+// endpoint.
+type BackendHealth struct {
+	Healthy bool `json:"healthy"`
+}
+
+type healthState struct {
+	unhealthy atomic.Bool
+}
+
+func (h *healthState) Get() BackendHealth {
+	return BackendHealth{Healthy: !h.unhealthy.Load()}
+}
+
+func (h *healthState) Set(health BackendHealth) {
+	h.unhealthy.Store(!health.Healthy)
+}
+
+func validateHealthPath(healthPath string) error {
+	if !strings.HasPrefix(healthPath, "/") || healthPath == "/" || strings.HasPrefix(healthPath, controlPathPrefix) {
+		return fmt.Errorf("invalid health path %q", healthPath)
+	}
+	return nil
+}
+
+// Handler serves the health endpoint that HAProxy checks: 200 while
+// healthy, 503 otherwise.
+func (h *healthState) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !h.Get().Healthy {
+			http.Error(w, "unhealthy", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = fmt.Fprintln(w, "ok")
+	})
+}
+
+// ServeHTTP implements the backend's /_hydra/health control
+// endpoint: GET returns the current state, PUT or POST replaces it.
+func (h *healthState) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		health := h.Get()
+		if err := decoder.Decode(&health); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.Set(health)
+	default:
+		http.Error(w, r.Method, http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := json.Marshal(h.Get())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
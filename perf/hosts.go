@@ -9,7 +9,7 @@ func (c *GenHostsCmd) Run(p *ProgramCtx) error {
 	if c.IPAddress != "" {
 		addr = c.IPAddress
 	}
-	for _, t := range AllTrafficTypes {
+	for _, t := range p.TrafficTypes() {
 		for i := 0; i < p.Nbackends; i++ {
 			hostname := fmt.Sprintf("%v-%v-%v", p.HostPrefix, t, i)
 			fmt.Println(addr, hostname)
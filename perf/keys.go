@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+)
+
+// KeyType selects the algorithm and size of generated keys.
+// Handshake cost differs by an order of magnitude between them.
+type KeyType string
+
+const (
+	KeyTypeRSA2048   KeyType = "rsa2048"
+	KeyTypeRSA3072   KeyType = "rsa3072"
+	KeyTypeRSA4096   KeyType = "rsa4096"
+	KeyTypeECDSAP256 KeyType = "ecdsa-p256"
+	KeyTypeECDSAP384 KeyType = "ecdsa-p384"
+
+	// KeyTypeEd25519 needs HAProxy built against OpenSSL 1.1.1
+	// or later, and few clients other than Go and curl accept it.
+	KeyTypeEd25519 KeyType = "ed25519"
+)
+
+// generateKey returns a new private key of type t.
+func generateKey(t KeyType) (crypto.Signer, error) {
+	switch t {
+	case KeyTypeRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyTypeRSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case KeyTypeRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case KeyTypeECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyTypeEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("unknown key type %q", t)
+}
+
+// keyTypeOf reports the KeyType of key.
+func keyTypeOf(key crypto.Signer) (KeyType, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		switch k.N.BitLen() {
+		case 2048:
+			return KeyTypeRSA2048, nil
+		case 3072:
+			return KeyTypeRSA3072, nil
+		case 4096:
+			return KeyTypeRSA4096, nil
+		}
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return KeyTypeECDSAP256, nil
+		case elliptic.P384():
+			return KeyTypeECDSAP384, nil
+		}
+	case ed25519.PrivateKey:
+		return KeyTypeEd25519, nil
+	}
+	return "", fmt.Errorf("unsupported key %T", key)
+}
+
+// keyUsage is the key usage of a leaf certificate for key: only RSA
+// keys are used for key encipherment.
+func keyUsage(key crypto.Signer) x509.KeyUsage {
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		return x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature
+	}
+	return x509.KeyUsageDigitalSignature
+}
+
+// encodePrivateKeyPEM encodes RSA keys as PKCS #1, ECDSA keys as SEC 1
+// and Ed25519 keys as PKCS #8, the forms HAProxy and OpenSSL expect.
+func encodePrivateKeyPEM(key crypto.Signer) (string, error) {
+	var block *pem.Block
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return "", err
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	default:
+		der, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			return "", err
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	}
+
+	return string(pem.EncodeToMemory(block)), nil
+}
+
+func parsePrivateKeyPEM(data string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode private key")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key %T", key)
+	}
+
+	return signer, nil
+}
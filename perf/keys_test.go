@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+)
+
+func TestKeyTypes(t *testing.T) {
+	for _, keyType := range []KeyType{
+		KeyTypeRSA2048,
+		KeyTypeRSA3072,
+		KeyTypeRSA4096,
+		KeyTypeECDSAP256,
+		KeyTypeECDSAP384,
+		KeyTypeEd25519,
+	} {
+		if testing.Short() && (keyType == KeyTypeRSA3072 || keyType == KeyTypeRSA4096) {
+			continue
+		}
+
+		certBundle, err := CreateTLSCerts(keyType, 0, time.Now(), time.Now().AddDate(1, 0, 0), "localhost")
+		if err != nil {
+			t.Fatalf("%s: failed to generate certificates: %v", keyType, err)
+		}
+
+		// An empty key type reissues with the key type of the
+		// existing leaf.
+		reissued, err := ReissueTLSCerts(certBundle, "", time.Now(), time.Now().AddDate(1, 0, 0), "reissued.example")
+		if err != nil {
+			t.Fatalf("%s: failed to reissue certificates: %v", keyType, err)
+		}
+
+		for _, certs := range []*Certificates{certBundle, reissued} {
+			if _, err := tls.X509KeyPair([]byte(certs.LeafCertPEM), []byte(certs.LeafKeyPEM)); err != nil {
+				t.Errorf("%s: failed to create key pair: %v", keyType, err)
+			}
+
+			key, err := parsePrivateKeyPEM(certs.LeafKeyPEM)
+			if err != nil {
+				t.Fatalf("%s: %v", keyType, err)
+			}
+
+			if got, err := keyTypeOf(key); err != nil || got != keyType {
+				t.Errorf("%s: leaf key has type %q (%v)", keyType, got, err)
+			}
+		}
+
+		key, err := generateKey(keyType)
+		if err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+
+		data, err := encodePrivateKeyPEM(key)
+		if err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+
+		parsed, err := parsePrivateKeyPEM(data)
+		if err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+
+		if got, err := keyTypeOf(parsed); err != nil || got != keyType {
+			t.Errorf("%s: PEM round trip returned key type %q (%v)", keyType, got, err)
+		}
+	}
+
+	if _, err := generateKey("dsa1024"); err == nil {
+		t.Error("expected an error for an unknown key type")
+	}
+}
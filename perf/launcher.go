@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"sync"
+	"syscall"
+)
+
+// backendHandle controls one running backend server, whether it runs
+// as a child process or as a goroutine.
+type backendHandle struct {
+	backend Backend
+	done    chan struct{}
+	err     error
+	pid     int
+	stop    func()
+
+	// exit describes how the backend exited and failed reports
+	// whether that was an error; both are valid once done is
+	// closed.
+	exit   string
+	failed bool
+
+	stopOnce  sync.Once
+	stopped   bool
+	stoppedMu sync.Mutex
+}
+
+// Stop asks the backend to exit and waits until it has.
+func (h *backendHandle) Stop() {
+	h.stopOnce.Do(func() {
+		h.stoppedMu.Lock()
+		h.stopped = true
+		h.stoppedMu.Unlock()
+		h.stop()
+	})
+	<-h.done
+}
+
+// Done is closed once the backend has exited; Err is then valid.
+func (h *backendHandle) Done() <-chan struct{} {
+	return h.done
+}
+
+func (h *backendHandle) Err() error {
+	<-h.done
+	return h.err
+}
+
+// Stopped reports whether the backend exited because Stop was called.
+func (h *backendHandle) Stopped() bool {
+	h.stoppedMu.Lock()
+	defer h.stoppedMu.Unlock()
+	return h.stopped
+}
+
+// backendHandles tracks the currently running backend servers by ID.
+type backendHandles struct {
+	sync.Mutex
+	handles map[string]*backendHandle
+}
+
+func newBackendHandles() *backendHandles {
+	return &backendHandles{handles: map[string]*backendHandle{}}
+}
+
+func (s *backendHandles) Put(h *backendHandle) {
+	s.Lock()
+	defer s.Unlock()
+	s.handles[h.backend.ID()] = h
+}
+
+func (s *backendHandles) Get(id string) (*backendHandle, bool) {
+	s.Lock()
+	defer s.Unlock()
+	h, ok := s.handles[id]
+	return h, ok
+}
+
+func (s *backendHandles) All() []*backendHandle {
+	s.Lock()
+	defer s.Unlock()
+	result := make([]*backendHandle, 0, len(s.handles))
+	for _, h := range s.handles {
+		result = append(result, h)
+	}
+	return result
+}
+
+// startBackend starts backend as a child process or, with
+// --in-process, as a goroutine. exited is called if the backend
+// exits without being stopped while ctx is still live.
+func (c *ServeBackendsCmd) startBackend(ctx context.Context, p *ProgramCtx, backend Backend, tlsConfig *tls.Config, registry *backendRegistry, exited func(*backendHandle)) (*backendHandle, error) {
+	h := &backendHandle{
+		backend: backend,
+		done:    make(chan struct{}),
+	}
+
+	var wait func()
+
+	if c.InProcess {
+		if !backend.TrafficType.BackendTLS() {
+			tlsConfig = nil
+		}
+		backendCtx, cancel := context.WithCancel(ctx)
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- serveBackend(backendCtx, backend, c.ListenAddress, c.BackendOptions, tlsConfig, registry)
+		}()
+		h.stop = cancel
+		wait = func() {
+			defer cancel()
+			h.err = <-errCh
+			h.exit, h.failed = "returned", false
+			if h.err != nil {
+				h.exit, h.failed = h.err.Error(), true
+			}
+		}
+	} else {
+		cmd, err := c.spawnBackend(p, backend)
+		if err != nil {
+			return nil, err
+		}
+		h.stop = func() {
+			_ = cmd.Process.Signal(syscall.SIGTERM)
+		}
+		h.pid = cmd.Process.Pid
+		wait = func() {
+			h.err = cmd.Wait()
+			if cmd.ProcessState == nil {
+				h.exit, h.failed = h.err.Error(), true
+				return
+			}
+			h.exit, h.failed = cmd.ProcessState.String(), !cmd.ProcessState.Success()
+		}
+	}
+
+	go func() {
+		wait()
+		close(h.done)
+		if !h.Stopped() && ctx.Err() == nil {
+			exited(h)
+		}
+	}()
+
+	return h, nil
+}
+
+func (s *backendHandles) Delete(id string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.handles, id)
+}
@@ -29,11 +29,19 @@ type MBRequestConfig struct {
 	TrafficTypes      []TrafficType
 }
 
+// filterInTrafficByType returns one backend per route for each of
+// types; requests target the route, not its individual servers.
 func filterInTrafficByType(types []TrafficType, backendsMap BoundBackendsByTrafficType) []BoundBackend {
 	var result []BoundBackend
 
 	for _, t := range types {
-		result = append(result, backendsMap[t]...)
+		seen := map[string]bool{}
+		for _, b := range backendsMap[t] {
+			if !seen[b.Name] {
+				seen[b.Name] = true
+				result = append(result, b)
+			}
+		}
 	}
 
 	return result
@@ -44,7 +52,7 @@ type schemeSelector func(t TrafficType) string
 
 func haproxyPortSelector(b BoundBackend, cfg Globals) int {
 	switch b.TrafficType {
-	case HTTPTraffic:
+	case HTTPTraffic, GRPCTraffic:
 		return cfg.HTTPPort
 	default:
 		return cfg.HTTPSPort
@@ -53,7 +61,7 @@ func haproxyPortSelector(b BoundBackend, cfg Globals) int {
 
 func haproxySNIOnlyPortSelector(b BoundBackend, cfg Globals) int {
 	switch b.TrafficType {
-	case HTTPTraffic:
+	case HTTPTraffic, GRPCTraffic:
 		return cfg.HTTPPort
 	default:
 		return cfg.HTTPSPortSNIOnly
@@ -62,7 +70,7 @@ func haproxySNIOnlyPortSelector(b BoundBackend, cfg Globals) int {
 
 func haproxySchemeSelector(t TrafficType) string {
 	switch t {
-	case HTTPTraffic:
+	case HTTPTraffic, GRPCTraffic:
 		return "http"
 	default:
 		return "https"
@@ -74,12 +82,10 @@ func directPortSelector(b BoundBackend, cfg Globals) int {
 }
 
 func directSchemeSelector(t TrafficType) string {
-	switch t {
-	case HTTPTraffic, EdgeTraffic:
+	if !t.BackendTLS() {
 		return "http"
-	default:
-		return "https"
 	}
+	return "https"
 }
 
 func generateMBRequests(p *ProgramCtx, portSelector portSelector, schemeSelector schemeSelector, cfg MBRequestConfig, backends []BoundBackend) []MBRequest {
@@ -107,11 +113,28 @@ func (c *GenWorkloadCmd) Run(p *ProgramCtx) error {
 		return err
 	}
 
-	backendsByTrafficType, err := fetchAllBackendMetadata(p.DiscoveryURL)
+	backendsByTrafficType, err := backendMetadata(p)
 	if err != nil {
 		return err
 	}
 
+	type trafficMix struct {
+		Name         string
+		TrafficTypes []TrafficType
+	}
+
+	requestCfgs := []trafficMix{
+		{"edge", []TrafficType{EdgeTraffic}},
+		{"http", []TrafficType{HTTPTraffic}},
+		{"mix", AllTrafficTypes[:]},
+		{"passthrough", []TrafficType{PassthroughTraffic}},
+		{"reencrypt", []TrafficType{ReencryptTraffic}},
+	}
+
+	if p.GRPC {
+		requestCfgs = append(requestCfgs, trafficMix{"grpc", []TrafficType{GRPCTraffic}})
+	}
+
 	for _, workload := range []struct {
 		subdir         string
 		useProxy       bool
@@ -123,16 +146,7 @@ func (c *GenWorkloadCmd) Run(p *ProgramCtx) error {
 		{"haproxy-reencrypt-only", true, haproxySNIOnlyPortSelector, haproxySchemeSelector},
 	} {
 		for _, clients := range []int{1, 2, 5, 10, 50, 75, 80, 90, 100, 200} {
-			for _, requestCfg := range []struct {
-				Name         string
-				TrafficTypes []TrafficType
-			}{
-				{"edge", []TrafficType{EdgeTraffic}},
-				{"http", []TrafficType{HTTPTraffic}},
-				{"mix", AllTrafficTypes[:]},
-				{"passthrough", []TrafficType{PassthroughTraffic}},
-				{"reencrypt", []TrafficType{ReencryptTraffic}},
-			} {
+			for _, requestCfg := range requestCfgs {
 				if workload.subdir == "haproxy-reencrypt-only" && requestCfg.Name != "reencrypt" {
 					continue
 				}
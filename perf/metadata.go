@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -48,3 +49,55 @@ func fetchCertficates(uri string) (*Certificates, error) {
 	}
 	return nil, fmt.Errorf("/certs request failed %v", resp.StatusCode)
 }
+
+// requestCertificates asks the serve-backends at uri to cover names
+// with its leaf certificate and returns its certificate bundle.
+func requestCertificates(uri string, names []string) (*Certificates, error) {
+	data, err := json.Marshal(names)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Post(fmt.Sprintf("%s/certs", uri), "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer func(Body io.ReadCloser) { _ = Body.Close() }(resp.Body)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("/certs request failed %v: %s", resp.StatusCode, body)
+	}
+	var certBundle Certificates
+	if err := json.Unmarshal(body, &certBundle); err != nil {
+		return nil, err
+	}
+	return &certBundle, nil
+}
+
+// backendMetadata returns the backends from the snapshot file, if
+// one was given, or else from the metadata server.
+func backendMetadata(p *ProgramCtx) (BoundBackendsByTrafficType, error) {
+	if p.Snapshot == "" {
+		return fetchAllBackendMetadata(p.DiscoveryURL)
+	}
+	snapshot, err := readSnapshot(p.Snapshot)
+	if err != nil {
+		return nil, err
+	}
+	return snapshot.Backends, nil
+}
+
+// certificates returns the certificate bundle from the snapshot
+// file, if one was given, or else from the metadata server.
+func certificates(p *ProgramCtx) (*Certificates, error) {
+	if p.Snapshot == "" {
+		return fetchCertficates(p.DiscoveryURL)
+	}
+	snapshot, err := readSnapshot(p.Snapshot)
+	if err != nil {
+		return nil, err
+	}
+	return snapshot.Certificates, nil
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// A minimal OCSP (RFC 6960) responder and client, enough for HAProxy
+// and OpenSSL to staple and check responses signed by the test CA.
+// Every certificate of the CA is reported good: nothing is revoked.
+
+const (
+	ocspSuccessful       asn1.Enumerated = 0
+	ocspMalformedRequest asn1.Enumerated = 1
+	ocspInternalError    asn1.Enumerated = 2
+	ocspUnauthorized     asn1.Enumerated = 6
+)
+
+// ocspValidity is how long responses may be cached and stapled.
+const ocspValidity = 7 * 24 * time.Hour
+
+var (
+	oidOCSPBasic = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+
+	oidSHA1   = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+
+	oidSHA256WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidEd25519         = asn1.ObjectIdentifier{1, 3, 101, 112}
+)
+
+type ocspCertID struct {
+	HashAlgorithm  pkix.AlgorithmIdentifier
+	IssuerNameHash []byte
+	IssuerKeyHash  []byte
+	SerialNumber   *big.Int
+}
+
+type ocspSingleRequest struct {
+	CertID     ocspCertID
+	Extensions []pkix.Extension `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspTBSRequest struct {
+	Version       int           `asn1:"explicit,tag:0,default:0,optional"`
+	RequestorName asn1.RawValue `asn1:"explicit,tag:1,optional"`
+	RequestList   []ocspSingleRequest
+	Extensions    []pkix.Extension `asn1:"explicit,tag:2,optional"`
+}
+
+type ocspRequest struct {
+	TBSRequest ocspTBSRequest
+	Signature  asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type ocspResponse struct {
+	Status        asn1.Enumerated
+	ResponseBytes ocspResponseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspSingleResponse struct {
+	CertID     ocspCertID
+	Good       asn1.Flag `asn1:"tag:0,optional"`
+	ThisUpdate time.Time `asn1:"generalized"`
+	NextUpdate time.Time `asn1:"generalized,explicit,tag:0,optional"`
+}
+
+type ocspResponseData struct {
+	Version     int           `asn1:"explicit,tag:0,default:0,optional"`
+	ResponderID asn1.RawValue // byKey [2]
+	ProducedAt  time.Time     `asn1:"generalized"`
+	Responses   []ocspSingleResponse
+}
+
+type ocspBasicResponse struct {
+	TBSResponseData    asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+}
+
+func ocspHash(oid asn1.ObjectIdentifier) (crypto.Hash, bool) {
+	switch {
+	case oid.Equal(oidSHA1):
+		return crypto.SHA1, true
+	case oid.Equal(oidSHA256):
+		return crypto.SHA256, true
+	case oid.Equal(oidSHA384):
+		return crypto.SHA384, true
+	case oid.Equal(oidSHA512):
+		return crypto.SHA512, true
+	}
+	return 0, false
+}
+
+// issuerHashes returns the hashes of the issuer's name and public key
+// that identify it in a CertID.
+func issuerHashes(issuer *x509.Certificate, hash crypto.Hash) ([]byte, []byte, error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return nil, nil, err
+	}
+
+	h := hash.New()
+	h.Write(issuer.RawSubject)
+	nameHash := h.Sum(nil)
+
+	h.Reset()
+	h.Write(spki.PublicKey.RightAlign())
+
+	return nameHash, h.Sum(nil), nil
+}
+
+// ocspSignatureAlgorithm returns how key signs responses.
+func ocspSignatureAlgorithm(key crypto.Signer) (pkix.AlgorithmIdentifier, crypto.Hash, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidSHA256WithRSA, Parameters: asn1.NullRawValue}, crypto.SHA256, nil
+	case *ecdsa.PrivateKey:
+		if k.Curve == elliptic.P384() {
+			return pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA384}, crypto.SHA384, nil
+		}
+		return pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}, crypto.SHA256, nil
+	case ed25519.PrivateKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidEd25519}, 0, nil
+	}
+	return pkix.AlgorithmIdentifier{}, 0, fmt.Errorf("unsupported key %T", key)
+}
+
+// createOCSPResponse answers request, saying that every certificate
+// of issuer it asks about is good. The response is signed by issuer
+// itself, so no delegated responder certificate is needed. If the
+// request cannot be answered the error comes with an unsuccessful
+// response to send.
+func createOCSPResponse(issuer *x509.Certificate, issuerPrivKey crypto.Signer, request []byte) ([]byte, error) {
+	status := func(s asn1.Enumerated) []byte {
+		data, _ := asn1.Marshal(ocspResponse{Status: s})
+		return data
+	}
+
+	var req ocspRequest
+	if rest, err := asn1.Unmarshal(request, &req); err != nil || len(rest) > 0 || len(req.TBSRequest.RequestList) == 0 {
+		return status(ocspMalformedRequest), fmt.Errorf("malformed request: %v", err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+
+	var responses []ocspSingleResponse
+
+	for _, r := range req.TBSRequest.RequestList {
+		hash, ok := ocspHash(r.CertID.HashAlgorithm.Algorithm)
+		if !ok {
+			return status(ocspMalformedRequest), fmt.Errorf("unsupported hash algorithm %v", r.CertID.HashAlgorithm.Algorithm)
+		}
+		nameHash, keyHash, err := issuerHashes(issuer, hash)
+		if err != nil {
+			return status(ocspInternalError), err
+		}
+		if !bytes.Equal(nameHash, r.CertID.IssuerNameHash) || !bytes.Equal(keyHash, r.CertID.IssuerKeyHash) {
+			return status(ocspUnauthorized), fmt.Errorf("request for serial %v is not for this CA", r.CertID.SerialNumber)
+		}
+		responses = append(responses, ocspSingleResponse{
+			CertID:     r.CertID,
+			Good:       true,
+			ThisUpdate: now.Add(-time.Minute),
+			NextUpdate: now.Add(ocspValidity),
+		})
+	}
+
+	_, keyHash, err := issuerHashes(issuer, crypto.SHA1)
+	if err != nil {
+		return status(ocspInternalError), err
+	}
+
+	responderKeyHash, err := asn1.Marshal(keyHash)
+	if err != nil {
+		return status(ocspInternalError), err
+	}
+
+	tbs, err := asn1.Marshal(ocspResponseData{
+		ResponderID: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true, Bytes: responderKeyHash},
+		ProducedAt:  now,
+		Responses:   responses,
+	})
+	if err != nil {
+		return status(ocspInternalError), err
+	}
+
+	signatureAlgorithm, hash, err := ocspSignatureAlgorithm(issuerPrivKey)
+	if err != nil {
+		return status(ocspInternalError), err
+	}
+
+	signed := tbs
+	if hash != 0 {
+		h := hash.New()
+		h.Write(tbs)
+		signed = h.Sum(nil)
+	}
+
+	signature, err := issuerPrivKey.Sign(rand.Reader, signed, hash)
+	if err != nil {
+		return status(ocspInternalError), err
+	}
+
+	basic, err := asn1.Marshal(ocspBasicResponse{
+		TBSResponseData:    asn1.RawValue{FullBytes: tbs},
+		SignatureAlgorithm: signatureAlgorithm,
+		Signature:          asn1.BitString{Bytes: signature, BitLength: 8 * len(signature)},
+	})
+	if err != nil {
+		return status(ocspInternalError), err
+	}
+
+	response, err := asn1.Marshal(ocspResponse{
+		Status: ocspSuccessful,
+		ResponseBytes: ocspResponseBytes{
+			ResponseType: oidOCSPBasic,
+			Response:     basic,
+		},
+	})
+	if err != nil {
+		return status(ocspInternalError), err
+	}
+
+	return response, nil
+}
+
+// ocspHandler is an OCSP responder for the leaves of the certificates
+// returned by bundle. It accepts requests as POST bodies and as
+// base64 in GET paths after prefix.
+func ocspHandler(prefix string, bundle func() *Certificates) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			request []byte
+			err     error
+		)
+
+		switch r.Method {
+		case http.MethodGet:
+			var encoded string
+			if encoded, err = url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), prefix)); err == nil {
+				request, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(encoded, "/"))
+			}
+		case http.MethodPost:
+			request, err = io.ReadAll(io.LimitReader(r.Body, 64<<10))
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		issuer, issuerPrivKey, err := leafIssuer(bundle())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response, err := createOCSPResponse(issuer, issuerPrivKey, request)
+		if err != nil {
+			log.Printf("OCSP: %v\n", err)
+		}
+
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		_, _ = w.Write(response)
+	}
+}
+
+// newOCSPRequest returns a request for the status of leaf.
+func newOCSPRequest(leaf, issuer *x509.Certificate) ([]byte, error) {
+	nameHash, keyHash, err := issuerHashes(issuer, crypto.SHA1)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(ocspRequest{
+		TBSRequest: ocspTBSRequest{
+			RequestList: []ocspSingleRequest{{
+				CertID: ocspCertID{
+					HashAlgorithm:  pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+					IssuerNameHash: nameHash,
+					IssuerKeyHash:  keyHash,
+					SerialNumber:   leaf.SerialNumber,
+				},
+			}},
+		},
+	})
+}
+
+// requestOCSPResponse asks the OCSP responder named in the leaf of
+// pemData, a domain PEM, for the leaf's status and returns the
+// response if it is successful.
+func requestOCSPResponse(pemData string) ([]byte, error) {
+	var chain []*x509.Certificate
+
+	for rest := []byte(pemData); ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, cert)
+	}
+
+	if len(chain) < 2 {
+		return nil, fmt.Errorf("no issuer certificate after the leaf")
+	}
+
+	leaf, issuer := chain[0], chain[1]
+
+	if len(leaf.OCSPServer) == 0 {
+		return nil, fmt.Errorf("certificate %v has no OCSP responder URL; start serve-backends with --ocsp or --ocsp-url", leaf.SerialNumber)
+	}
+
+	request, err := newOCSPRequest(leaf, issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		return nil, err
+	}
+	defer func(Body io.ReadCloser) { _ = Body.Close() }(resp.Body)
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OCSP request to %s failed %v: %s", leaf.OCSPServer[0], resp.StatusCode, body)
+	}
+
+	var response ocspResponse
+	if _, err := asn1.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("malformed OCSP response from %s: %v", leaf.OCSPServer[0], err)
+	}
+	if response.Status != ocspSuccessful {
+		return nil, fmt.Errorf("OCSP response status %d from %s", response.Status, leaf.OCSPServer[0])
+	}
+
+	return body, nil
+}
+
+// writeOCSPResponses fetches an OCSP response for each certificate
+// file and writes it to <file>.ocsp, where HAProxy looks for a
+// response to staple.
+func writeOCSPResponses(files []string) error {
+	var g errgroup.Group
+
+	g.SetLimit(32)
+
+	for _, file := range files {
+		file := file
+		g.Go(func() error {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			response, err := requestOCSPResponse(string(data))
+			if err != nil {
+				return fmt.Errorf("%s: %v", file, err)
+			}
+			return createFile(file+".ocsp", response)
+		})
+	}
+
+	return g.Wait()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/asn1"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOCSPResponder(t *testing.T) {
+	var certBundle *Certificates
+
+	server := httptest.NewServer(ocspHandler("/ocsp", func() *Certificates { return certBundle }))
+	defer server.Close()
+
+	rootCA, err := CreateRootCA(KeyTypeECDSAP256, time.Now(), time.Now().AddDate(1, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootCA.OCSPServer = server.URL + "/ocsp"
+
+	certBundle, err = IssueTLSCerts(rootCA, "", 1, time.Now(), time.Now().AddDate(1, 0, 0), "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := requestOCSPResponse(domainPEM(certBundle))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var response ocspResponse
+	if _, err := asn1.Unmarshal(data, &response); err != nil {
+		t.Fatal(err)
+	}
+
+	var basic ocspBasicResponse
+	if _, err := asn1.Unmarshal(response.ResponseBytes.Response, &basic); err != nil {
+		t.Fatal(err)
+	}
+
+	issuer, _, err := leafIssuer(certBundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := issuer.CheckSignature(issuer.SignatureAlgorithm, basic.TBSResponseData.FullBytes, basic.Signature.RightAlign()); err != nil {
+		t.Fatalf("response not signed by the leaf's issuer: %v", err)
+	}
+
+	if response.Status != ocspSuccessful || !response.ResponseBytes.ResponseType.Equal(oidOCSPBasic) {
+		t.Fatalf("expected a successful basic response, got status %d type %v", response.Status, response.ResponseBytes.ResponseType)
+	}
+
+	var tbs ocspResponseData
+	if _, err := asn1.Unmarshal(basic.TBSResponseData.FullBytes, &tbs); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tbs.Responses) != 1 {
+		t.Fatalf("expected 1 response, got %d", len(tbs.Responses))
+	}
+
+	single := tbs.Responses[0]
+
+	leaf, err := parseCertificatePEM(certBundle.LeafCertPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if single.CertID.SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+		t.Errorf("expected the response for serial %v, got %v", leaf.SerialNumber, single.CertID.SerialNumber)
+	}
+
+	nameHash, keyHash, err := issuerHashes(issuer, crypto.SHA1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(single.CertID.IssuerNameHash, nameHash) || !bytes.Equal(single.CertID.IssuerKeyHash, keyHash) {
+		t.Error("expected the CertID to identify the leaf's issuer")
+	}
+
+	if !single.Good {
+		t.Error("expected certificate status good")
+	}
+
+	if !single.NextUpdate.After(single.ThisUpdate) {
+		t.Errorf("expected nextUpdate %v after thisUpdate %v", single.NextUpdate, single.ThisUpdate)
+	}
+}
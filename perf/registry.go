@@ -0,0 +1,394 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+type BackendState string
+
+const (
+	// BackendLive backends have registered or sent a heartbeat
+	// recently.
+	BackendLive BackendState = "live"
+
+	// BackendStale backends have stopped sending heartbeats.
+	// They are not reported as endpoints until they send one
+	// again.
+	BackendStale BackendState = "stale"
+)
+
+type BackendEventType string
+
+const (
+	BackendAdded       BackendEventType = "added"
+	BackendPortChanged BackendEventType = "port-changed"
+	BackendRemoved     BackendEventType = "removed"
+)
+
+// BackendEvent is a change to the set of live backends. Version is
+// the resource version of the registry after the change.
+type BackendEvent struct {
+	Type    BackendEventType `json:"type"`
+	Version uint64           `json:"version"`
+	Backend BoundBackend     `json:"backend"`
+}
+
+// maxBackendEvents is how many events are kept for watchers resuming
+// from an earlier resource version.
+const maxBackendEvents = 8192
+
+type registration struct {
+	BoundBackend
+
+	lastSeen time.Time
+	stale    bool
+}
+
+// backendRegistry records which backends should be running, where
+// each one is listening and whether it is still alive. Backends
+// running as separate processes register through the metadata
+// server's /register endpoint; backends running in-process register
+// directly. Backends of other hosts, relayed by their serve-backends,
+// are accepted as they register and forgotten when they deregister or
+// go stale.
+type backendRegistry struct {
+	sync.Mutex
+
+	host string
+
+	backends BackendsByTrafficType
+	expected map[string]Backend
+	bound    map[string]*registration
+	changed  chan struct{}
+	events   []BackendEvent
+	version  uint64
+}
+
+func newBackendRegistry(host string) *backendRegistry {
+	return &backendRegistry{
+		host:     host,
+		backends: BackendsByTrafficType{},
+		expected: map[string]Backend{},
+		bound:    map[string]*registration{},
+		changed:  make(chan struct{}),
+	}
+}
+
+// notify records a change, giving each event its own resource
+// version, and wakes anyone waiting on Changed. The caller must hold
+// the lock.
+func (r *backendRegistry) notify(events ...BackendEvent) {
+	if len(events) == 0 {
+		return
+	}
+	for _, e := range events {
+		r.version++
+		e.Version = r.version
+		e.Backend.State = BackendLive
+		if e.Type == BackendRemoved {
+			e.Backend.State = ""
+		}
+		r.events = append(r.events, e)
+	}
+	if len(r.events) > 2*maxBackendEvents {
+		r.events = append([]BackendEvent(nil), r.events[len(r.events)-maxBackendEvents:]...)
+	}
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+func event(t BackendEventType, b BoundBackend) BackendEvent {
+	return BackendEvent{Type: t, Backend: b}
+}
+
+// Expect adds backends to the set that is allowed to register.
+func (r *backendRegistry) Expect(backends ...Backend) {
+	r.Lock()
+	defer r.Unlock()
+
+	for _, b := range backends {
+		if _, ok := r.expected[b.ID()]; ok {
+			continue
+		}
+		r.expected[b.ID()] = b
+		r.backends[b.TrafficType] = append(r.backends[b.TrafficType], b)
+	}
+}
+
+// Remove forgets backends and their registrations.
+func (r *backendRegistry) Remove(backends ...Backend) {
+	r.Lock()
+	defer r.Unlock()
+
+	var events []BackendEvent
+
+	for _, b := range backends {
+		if _, ok := r.expected[b.ID()]; !ok {
+			continue
+		}
+		if reg, ok := r.bound[b.ID()]; ok && !reg.stale {
+			events = append(events, event(BackendRemoved, reg.BoundBackend))
+		}
+		delete(r.bound, b.ID())
+		r.forget(b)
+	}
+
+	r.notify(events...)
+}
+
+// forget drops b from the expected backends; the caller must hold
+// the lock.
+func (r *backendRegistry) forget(b Backend) {
+	delete(r.expected, b.ID())
+	var remaining []Backend
+	for _, x := range r.backends[b.TrafficType] {
+		if x.ID() != b.ID() {
+			remaining = append(remaining, x)
+		}
+	}
+	r.backends[b.TrafficType] = remaining
+}
+
+// Register records b, one of the expected backends. A backend that
+// registers again, for example after being restarted on a new port,
+// replaces its earlier registration. Registering again with the same
+// address is a heartbeat.
+func (r *backendRegistry) Register(b BoundBackend) error {
+	r.Lock()
+	defer r.Unlock()
+
+	b.State, b.Status = "", nil
+
+	if _, ok := r.expected[b.ID()]; !ok {
+		return fmt.Errorf("unexpected registration for %s", b.ID())
+	}
+
+	r.register(b)
+	return nil
+}
+
+// RegisterRelayed records b, a backend of the host relay, which is
+// relaying the registrations of its own backends. Relayed backends
+// need not be expected.
+func (r *backendRegistry) RegisterRelayed(relay string, b BoundBackend) error {
+	r.Lock()
+	defer r.Unlock()
+
+	b.State, b.Status = "", nil
+
+	switch {
+	case b.Host == "":
+		return fmt.Errorf("registration for %s has no host", b.ID())
+	case b.Host != relay:
+		return fmt.Errorf("registration for %s relayed by host %q", b.ID(), relay)
+	case b.Host == r.host:
+		return fmt.Errorf("relayed registration for %s of this host", b.ID())
+	}
+
+	if _, ok := r.expected[b.ID()]; !ok {
+		r.expected[b.ID()] = b.Backend
+		r.backends[b.TrafficType] = append(r.backends[b.TrafficType], b.Backend)
+	}
+
+	r.register(b)
+	return nil
+}
+
+// register records b; the caller must hold the lock.
+func (r *backendRegistry) register(b BoundBackend) {
+	if old, ok := r.bound[b.ID()]; ok {
+		old.lastSeen = time.Now()
+		switch {
+		case old.stale:
+			log.Printf("backend %s is live again\n", b.ID())
+			old.BoundBackend = b
+			old.stale = false
+			r.notify(event(BackendAdded, b))
+		case old.BoundBackend != b:
+			log.Printf("backend %s moved from %s:%d to %s:%d\n", b.ID(), old.ListenAddress, old.Port, b.ListenAddress, b.Port)
+			old.BoundBackend = b
+			r.notify(event(BackendPortChanged, b))
+		}
+		return
+	}
+
+	r.bound[b.ID()] = &registration{
+		BoundBackend: b,
+		lastSeen:     time.Now(),
+	}
+	r.notify(event(BackendAdded, b))
+}
+
+// Heartbeat is Register; the registry makes no distinction.
+func (r *backendRegistry) Heartbeat(b BoundBackend) error {
+	return r.Register(b)
+}
+
+// Deregister forgets where b is listening. It is not an error if b
+// is not registered, or is now registered at another address.
+func (r *backendRegistry) Deregister(b BoundBackend) error {
+	r.Lock()
+	defer r.Unlock()
+
+	b.State, b.Status = "", nil
+
+	if old, ok := r.bound[b.ID()]; ok && old.BoundBackend == b {
+		delete(r.bound, b.ID())
+		if !old.stale {
+			r.notify(event(BackendRemoved, b))
+		}
+		if b.Host != r.host {
+			r.forget(b.Backend)
+		}
+	}
+
+	return nil
+}
+
+// Expire marks backends that have not been seen for staleAfter as
+// stale. Stale backends of other hosts are forgotten: nothing but
+// their relay would restart them, and it registers them again if it
+// is still running.
+func (r *backendRegistry) Expire(staleAfter time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+
+	var events []BackendEvent
+
+	for id, reg := range r.bound {
+		if !reg.stale && time.Since(reg.lastSeen) > staleAfter {
+			log.Printf("backend %s is stale; last seen %v ago\n", id, time.Since(reg.lastSeen).Round(time.Millisecond))
+			reg.stale = true
+			events = append(events, event(BackendRemoved, reg.BoundBackend))
+		}
+		if reg.stale && reg.Host != r.host {
+			delete(r.bound, id)
+			r.forget(reg.Backend)
+		}
+	}
+
+	r.notify(events...)
+}
+
+// Changed returns a channel that is closed on the next change.
+func (r *backendRegistry) Changed() <-chan struct{} {
+	r.Lock()
+	defer r.Unlock()
+	return r.changed
+}
+
+// Version is the resource version: it increases with every event.
+func (r *backendRegistry) Version() uint64 {
+	r.Lock()
+	defer r.Unlock()
+	return r.version
+}
+
+// EventsSince returns the events after resource version since. It
+// returns false if events from that far back are no longer kept.
+func (r *backendRegistry) EventsSince(since uint64) ([]BackendEvent, bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	if since >= r.version {
+		return nil, true
+	}
+
+	if len(r.events) == 0 || r.events[0].Version > since+1 {
+		return nil, false
+	}
+
+	i := int(since + 1 - r.events[0].Version)
+	return append([]BackendEvent(nil), r.events[i:]...), true
+}
+
+// List returns the live backends as "added" events together with the
+// resource version they correspond to, so that a watcher can start
+// from a consistent state.
+func (r *backendRegistry) List() ([]BackendEvent, uint64) {
+	r.Lock()
+	defer r.Unlock()
+
+	var events []BackendEvent
+	for _, t := range knownTrafficTypes() {
+		for _, b := range r.backends[t] {
+			if reg, ok := r.bound[b.ID()]; ok && !reg.stale {
+				bound := reg.BoundBackend
+				bound.State = BackendLive
+				events = append(events, BackendEvent{Type: BackendAdded, Version: r.version, Backend: bound})
+			}
+		}
+	}
+	return events, r.version
+}
+
+func (r *backendRegistry) Expected(id string) bool {
+	r.Lock()
+	defer r.Unlock()
+	_, ok := r.expected[id]
+	return ok
+}
+
+// Lookup returns where the backend with id is listening, if it is
+// live.
+func (r *backendRegistry) Lookup(id string) (BoundBackend, bool) {
+	r.Lock()
+	defer r.Unlock()
+	reg, ok := r.bound[id]
+	if !ok || reg.stale {
+		return BoundBackend{}, false
+	}
+	return reg.BoundBackend, true
+}
+
+// Bound returns the live backends.
+func (r *backendRegistry) Bound() []BoundBackend {
+	r.Lock()
+	defer r.Unlock()
+	result := make([]BoundBackend, 0, len(r.bound))
+	for _, reg := range r.bound {
+		if !reg.stale {
+			result = append(result, reg.BoundBackend)
+		}
+	}
+	return result
+}
+
+// Backends returns the expected backends in the order they were
+// added.
+func (r *backendRegistry) Backends() BackendsByTrafficType {
+	r.Lock()
+	defer r.Unlock()
+	result := BackendsByTrafficType{}
+	for t, backends := range r.backends {
+		result[t] = append([]Backend(nil), backends...)
+	}
+	return result
+}
+
+// BoundBackends returns the expected backends that have registered,
+// in the order they were added, together with their state. Stale
+// backends are only included if includeStale is set.
+func (r *backendRegistry) BoundBackends(includeStale bool) BoundBackendsByTrafficType {
+	r.Lock()
+	defer r.Unlock()
+	result := BoundBackendsByTrafficType{}
+	for _, t := range knownTrafficTypes() {
+		for _, b := range r.backends[t] {
+			reg, ok := r.bound[b.ID()]
+			if !ok || (reg.stale && !includeStale) {
+				continue
+			}
+			bound := reg.BoundBackend
+			bound.State = BackendLive
+			if reg.stale {
+				bound.State = BackendStale
+			}
+			result[t] = append(result[t], bound)
+		}
+	}
+	return result
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRegistryRejectsUnexpectedRegistrations(t *testing.T) {
+	r := newBackendRegistry("central")
+
+	local := Backend{Host: "central", Name: "edge-0", TrafficType: EdgeTraffic}
+	r.Expect(local)
+
+	if err := r.Register(BoundBackend{Backend: local, Port: 1}); err != nil {
+		t.Errorf("expected backend: unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		relay string
+		host  string
+	}{
+		{name: "unrelayed backend of another host", host: "remote"},
+		{name: "backend without a host", relay: "remote"},
+		{name: "backend of another host than the relay", relay: "remote", host: "other"},
+		{name: "backend of this host", relay: "central", host: "central"},
+	} {
+		b := BoundBackend{Backend: Backend{Host: tc.host, Name: "http-0", TrafficType: HTTPTraffic}, Port: 1}
+		var err error
+		if tc.relay == "" {
+			err = r.Register(b)
+		} else {
+			err = r.RegisterRelayed(tc.relay, b)
+		}
+		if err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+
+	if n := len(r.Backends()[HTTPTraffic]); n != 0 {
+		t.Errorf("expected no http backends, got %d", n)
+	}
+}
+
+func TestRegistryForgetsStaleRelayedBackends(t *testing.T) {
+	r := newBackendRegistry("central")
+
+	local := Backend{Host: "central", Name: "edge-0", TrafficType: EdgeTraffic}
+	remote := Backend{Host: "remote", Name: "edge-0", TrafficType: EdgeTraffic}
+
+	r.Expect(local)
+	if err := r.Register(BoundBackend{Backend: local, Port: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RegisterRelayed("remote", BoundBackend{Backend: remote, Port: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	r.Expire(time.Millisecond)
+
+	if r.Expected(remote.ID()) {
+		t.Errorf("expected stale relayed backend %s to be forgotten", remote.ID())
+	}
+	if !r.Expected(local.ID()) {
+		t.Errorf("expected stale local backend %s to be kept", local.ID())
+	}
+	if bound := r.BoundBackends(true)[EdgeTraffic]; len(bound) != 1 || bound[0].State != BackendStale {
+		t.Errorf("expected only the local backend, stale, got %+v", bound)
+	}
+
+	// The relay registers it again if it is still running.
+	if err := r.RegisterRelayed("remote", BoundBackend{Backend: remote, Port: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if !r.Expected(remote.ID()) {
+		t.Errorf("expected relayed backend %s to be registered again", remote.ID())
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// relayHostHeader names the host whose backends a relay registers
+// with the central metadata server. Registrations of backends of other
+// hosts are only accepted with it.
+const relayHostHeader = "X-Relay-Host"
+
+// relayRegistrations mirrors the live backends in registry to the
+// central metadata server until ctx is done: registrations and port
+// changes are registered, removals deregistered, and every live
+// backend is sent a heartbeat each interval. On the way out every
+// live backend is deregistered.
+func relayRegistrations(ctx context.Context, registry *backendRegistry, central *metadataServer, heartbeat time.Duration) error {
+	events, version := registry.List()
+
+	var tick <-chan time.Time
+	if heartbeat > 0 {
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		changed := registry.Changed()
+
+		relayEvents(central, events)
+		if len(events) > 0 {
+			version = events[len(events)-1].Version
+		}
+		events = nil
+
+		select {
+		case <-ctx.Done():
+			var removed []BackendEvent
+			for _, b := range registry.Bound() {
+				removed = append(removed, event(BackendRemoved, b))
+			}
+			relayEvents(central, removed)
+			return nil
+		case <-tick:
+			g := errgroup.Group{}
+			g.SetLimit(32)
+			for _, b := range registry.Bound() {
+				b := b
+				g.Go(func() error {
+					if err := central.Heartbeat(b); err != nil {
+						log.Printf("relay: %v\n", err)
+					}
+					return nil
+				})
+			}
+			_ = g.Wait()
+		case <-changed:
+			var ok bool
+			if events, ok = registry.EventsSince(version); !ok {
+				// Too far behind: register everything
+				// again. Backends removed meanwhile go
+				// stale on the central server.
+				events, version = registry.List()
+			}
+		}
+	}
+}
+
+// relayEvents sends events to central, in order for each backend and
+// concurrently across backends.
+func relayEvents(central *metadataServer, events []BackendEvent) {
+	var ids []string
+	byID := map[string][]BackendEvent{}
+	for _, e := range events {
+		id := e.Backend.ID()
+		if _, ok := byID[id]; !ok {
+			ids = append(ids, id)
+		}
+		byID[id] = append(byID[id], e)
+	}
+
+	g := errgroup.Group{}
+	g.SetLimit(32)
+	for _, id := range ids {
+		events := byID[id]
+		g.Go(func() error {
+			for _, e := range events {
+				var err error
+				switch e.Type {
+				case BackendAdded, BackendPortChanged:
+					err = central.Register(e.Backend)
+				case BackendRemoved:
+					err = central.Deregister(e.Backend)
+				}
+				if err != nil {
+					log.Printf("relay: %v\n", err)
+				}
+			}
+			return nil
+		})
+	}
+	_ = g.Wait()
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RotateRuntimeAPI = "runtime-api"
+	RotateReload     = "reload"
+)
+
+// RotationRecord describes one rotation and what the TLS probe saw
+// through HAProxy from its start until the next one.
+type RotationRecord struct {
+	Start        time.Time   `json:"start"`
+	DurationMs   float64     `json:"duration_ms"`
+	Method       string      `json:"method"`
+	Certificates []string    `json:"certificates"`
+	Errors       []string    `json:"errors,omitempty"`
+	Probe        *ProbeStats `json:"probe,omitempty"`
+}
+
+// ProbeStats are the results of probing HAProxy with new TLS
+// handshakes and with requests on one long-lived connection.
+// KeepAliveReconnects counts the times that connection had to be
+// re-established, typically because a reload closed it.
+// NewCertSeenAfterMs is how long after the rotation finished a
+// handshake first returned one of the new leaves; it is unset if the
+// probed route was not rotated or the new leaf was never seen.
+type ProbeStats struct {
+	Handshakes          uint64   `json:"handshakes"`
+	HandshakeErrors     uint64   `json:"handshake_errors"`
+	MaxHandshakeMs      float64  `json:"max_handshake_ms"`
+	KeepAliveRequests   uint64   `json:"keepalive_requests"`
+	KeepAliveErrors     uint64   `json:"keepalive_errors"`
+	KeepAliveReconnects uint64   `json:"keepalive_reconnects"`
+	NewCertSeenAfterMs  *float64 `json:"new_cert_seen_after_ms,omitempty"`
+}
+
+func (c *RotateCertsCmd) Run(p *ProgramCtx) error {
+	if c.Interval <= 0 {
+		return fmt.Errorf("--interval must be positive")
+	}
+
+	if c.Batch < 0 {
+		return fmt.Errorf("--batch must not be negative")
+	}
+
+	if c.Method == RotateReload && c.ReloadCommand == "" {
+		return fmt.Errorf("--reload-command is required with --method=%s", RotateReload)
+	}
+
+	socket := c.Socket
+	if socket == "" {
+		socket = path.Join(p.OutputDir, "haproxy", "haproxy.sock")
+	}
+
+	certBundle, err := certificates(p)
+	if err != nil {
+		return err
+	}
+
+	files, err := haproxyCertificateFiles(haproxyCertDir(p.OutputDir))
+	if err != nil {
+		return err
+	}
+
+	recordFile, err := os.OpenFile(path.Join(p.OutputDir, "rotation.jsonl"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer func(f *os.File) { _ = f.Close() }(recordFile)
+
+	var probe *tlsProbe
+
+	if c.ProbeInterval > 0 {
+		probeHost := c.ProbeHost
+		if probeHost == "" {
+			probeHost = fmt.Sprintf("%s-%v-0", p.HostPrefix, EdgeTraffic)
+		}
+		probe = newTLSProbe(fmt.Sprintf("127.0.0.1:%d", p.HTTPSPort), probeHost, certBundle)
+		go probe.run(p.Context, c.ProbeInterval)
+	}
+
+	log.Printf("rotating %d certificate(s) every %v using %s\n", len(files), c.Interval, c.Method)
+
+	// Each record is written at the next tick, or on exit, so that
+	// it includes what the probe saw after the rotation.
+	var pending *RotationRecord
+
+	flush := func() error {
+		if pending == nil {
+			return nil
+		}
+		if probe != nil {
+			pending.Probe = probe.stats()
+		}
+		data, err := json.Marshal(pending)
+		if err != nil {
+			return err
+		}
+		pending = nil
+		_, err = recordFile.Write(append(data, '\n'))
+		return err
+	}
+
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+
+	next, rotations := 0, 0
+
+	for {
+		select {
+		case <-p.Context.Done():
+			return flush()
+		case <-ticker.C:
+		}
+
+		if err := flush(); err != nil {
+			return err
+		}
+
+		var batch []string
+		batch, next = rotationBatch(files, next, c.Batch)
+
+		if probe != nil && rotations == 0 {
+			// Discard what the probe saw before the first
+			// rotation.
+			probe.stats()
+		}
+		rotations++
+
+		pending = c.rotate(p.Context, socket, certBundle, batch, probe)
+
+		log.Printf("rotated %d certificate(s) in %.1fms with %d error(s)\n", len(pending.Certificates), pending.DurationMs, len(pending.Errors))
+		for _, e := range pending.Errors {
+			log.Println(e)
+		}
+	}
+}
+
+// rotationBatch returns size of files, starting at next and wrapping
+// around, and where the following batch starts. A size of zero, or of
+// at least len(files), selects every file.
+func rotationBatch(files []string, next, size int) ([]string, int) {
+	if size <= 0 || size >= len(files) {
+		return files, next
+	}
+	batch := make([]string, 0, size)
+	for i := 0; i < size; i++ {
+		batch = append(batch, files[(next+i)%len(files)])
+	}
+	return batch, (next + size) % len(files)
+}
+
+// rotate reissues the leaf in each of files, writes it and pushes it
+// to HAProxy.
+func (c *RotateCertsCmd) rotate(ctx context.Context, socket string, certBundle *Certificates, files []string, probe *tlsProbe) *RotationRecord {
+	record := &RotationRecord{
+		Start:  time.Now(),
+		Method: c.Method,
+	}
+
+	serials := map[string]bool{}
+
+	for _, file := range files {
+		pemData, serial, err := reissueCertificateFile(certBundle, file)
+		if err == nil {
+			err = createFile(file, []byte(pemData))
+		}
+		// A stapled response is only good for the leaf it was
+		// issued for; replace it too.
+		var ocspResponse []byte
+		if _, statErr := os.Stat(file + ".ocsp"); err == nil && statErr == nil {
+			if ocspResponse, err = requestOCSPResponse(pemData); err == nil {
+				err = createFile(file+".ocsp", ocspResponse)
+			}
+		}
+		if err == nil && c.Method == RotateRuntimeAPI {
+			err = setSSLCert(socket, file, pemData, ocspResponse)
+		}
+		if err != nil {
+			record.Errors = append(record.Errors, fmt.Sprintf("%s: %v", file, err))
+			continue
+		}
+		serials[serial] = true
+		record.Certificates = append(record.Certificates, file)
+	}
+
+	if c.Method == RotateReload && len(record.Certificates) > 0 {
+		if output, err := exec.CommandContext(ctx, "sh", "-c", c.ReloadCommand).CombinedOutput(); err != nil {
+			record.Errors = append(record.Errors, fmt.Sprintf("%s: %v: %s", c.ReloadCommand, err, strings.TrimSpace(string(output))))
+		}
+	}
+
+	record.DurationMs = float64(time.Since(record.Start).Microseconds()) / 1000
+
+	if probe != nil {
+		probe.expect(serials)
+	}
+
+	return record
+}
+
+// haproxyCertificateFiles returns the certificate files HAProxy loads
+// from certDir: domain.pem and, if gen-proxy-config wrote per-route
+// certificates, each of those.
+func haproxyCertificateFiles(certDir string) ([]string, error) {
+	files := []string{certStore(certDir).DomainFile}
+
+	routeFiles, err := filepath.Glob(path.Join(certDir, "routes", "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(routeFiles)
+
+	for _, file := range append(files, routeFiles...) {
+		if _, err := os.Stat(file); err != nil {
+			return nil, fmt.Errorf("%v; run gen-proxy-config first", err)
+		}
+	}
+
+	return append(files, routeFiles...), nil
+}
+
+// reissueCertificateFile issues a new leaf for the names, and with the
+// validity period, of the leaf in file. It returns the domain PEM and
+// the serial number of the new leaf.
+func reissueCertificateFile(certBundle *Certificates, file string) (string, string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", "", err
+	}
+
+	leaf, err := parseCertificatePEM(string(data))
+	if err != nil {
+		return "", "", err
+	}
+
+	names := leaf.DNSNames
+	for _, ip := range leaf.IPAddresses {
+		names = append(names, ip.String())
+	}
+
+	notBefore := time.Now()
+	certs, err := ReissueTLSCerts(certBundle, "", notBefore, notBefore.Add(leaf.NotAfter.Sub(leaf.NotBefore)), names...)
+	if err != nil {
+		return "", "", err
+	}
+
+	newLeaf, err := parseCertificatePEM(certs.LeafCertPEM)
+	if err != nil {
+		return "", "", err
+	}
+
+	return domainPEM(certs), newLeaf.SerialNumber.String(), nil
+}
+
+// setSSLCert replaces the certificate HAProxy loaded from file with
+// pemData, and its stapled OCSP response if ocspResponse is set, in a
+// runtime API transaction.
+func setSSLCert(socket, file, pemData string, ocspResponse []byte) error {
+	// name, payload
+	payloads := [][2]string{{file, strings.TrimSuffix(pemData, "\n")}}
+
+	if ocspResponse != nil {
+		payloads = append(payloads, [2]string{file + ".ocsp", base64.StdEncoding.EncodeToString(ocspResponse)})
+	}
+
+	for _, payload := range payloads {
+		resp, err := haproxyCommand(socket, fmt.Sprintf("set ssl cert %s <<\n%s\n", payload[0], payload[1]))
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(resp, "Transaction created") && !strings.Contains(resp, "Transaction updated") {
+			_, _ = haproxyCommand(socket, "abort ssl cert "+file)
+			return fmt.Errorf("set ssl cert %s: %s", payload[0], strings.TrimSpace(resp))
+		}
+	}
+
+	resp, err := haproxyCommand(socket, "commit ssl cert "+file)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(resp, "Success!") {
+		return fmt.Errorf("commit ssl cert: %s", strings.TrimSpace(resp))
+	}
+
+	return nil
+}
+
+// haproxyCommand sends command to the HAProxy admin socket and
+// returns the response; HAProxy closes the connection after it.
+func haproxyCommand(socket, command string) (string, error) {
+	conn, err := net.DialTimeout("unix", socket, 5*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer func(conn net.Conn) { _ = conn.Close() }(conn)
+
+	if err := conn.SetDeadline(time.Now().Add(30 * time.Second)); err != nil {
+		return "", err
+	}
+
+	if _, err := io.WriteString(conn, command+"\n"); err != nil {
+		return "", err
+	}
+
+	resp, err := io.ReadAll(conn)
+	return string(resp), err
+}
+
+// tlsProbe measures, through HAProxy, new TLS handshakes to one route
+// and requests on a long-lived connection to it.
+type tlsProbe struct {
+	sync.Mutex
+
+	addr      string
+	client    *http.Client
+	tlsConfig *tls.Config
+	url       string
+
+	current     ProbeStats
+	expected    map[string]bool
+	expectSince time.Time
+	connected   bool
+}
+
+func newTLSProbe(addr, serverName string, certBundle *Certificates) *tlsProbe {
+	certPool := x509.NewCertPool()
+	certPool.AppendCertsFromPEM([]byte(certBundle.RootCACertPEM))
+
+	tlsConfig := &tls.Config{
+		RootCAs:    certPool,
+		ServerName: serverName,
+	}
+
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+
+	return &tlsProbe{
+		addr: addr,
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, network, addr)
+				},
+				MaxConnsPerHost: 1,
+				TLSClientConfig: tlsConfig,
+			},
+		},
+		tlsConfig: tlsConfig,
+		url:       fmt.Sprintf("https://%s/", serverName),
+	}
+}
+
+func (p *tlsProbe) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.handshake()
+			p.keepAlive(ctx)
+		}
+	}
+}
+
+func (p *tlsProbe) handshake() {
+	start := time.Now()
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", p.addr, p.tlsConfig)
+	elapsed := time.Since(start)
+
+	p.Lock()
+	defer p.Unlock()
+
+	p.current.Handshakes++
+	if err != nil {
+		p.current.HandshakeErrors++
+		return
+	}
+	defer func(conn *tls.Conn) { _ = conn.Close() }(conn)
+
+	if ms := float64(elapsed.Microseconds()) / 1000; ms > p.current.MaxHandshakeMs {
+		p.current.MaxHandshakeMs = ms
+	}
+
+	if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 && p.expected[certs[0].SerialNumber.String()] {
+		ms := float64(time.Since(p.expectSince).Microseconds()) / 1000
+		p.current.NewCertSeenAfterMs = &ms
+		p.expected = nil
+	}
+}
+
+func (p *tlsProbe) keepAlive(ctx context.Context) {
+	reused := true
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			reused = info.Reused
+		},
+	}
+
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodGet, p.url, nil)
+	if err != nil {
+		return
+	}
+
+	resp, err := p.client.Do(req)
+	if err == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	p.current.KeepAliveRequests++
+	if err != nil {
+		p.current.KeepAliveErrors++
+		return
+	}
+	if !reused && p.connected {
+		p.current.KeepAliveReconnects++
+	}
+	p.connected = true
+}
+
+// expect has the probe look for a leaf with one of serials from now
+// on.
+func (p *tlsProbe) expect(serials map[string]bool) {
+	p.Lock()
+	defer p.Unlock()
+	p.expected = serials
+	p.expectSince = time.Now()
+}
+
+// stats returns the results since the previous call.
+func (p *tlsProbe) stats() *ProbeStats {
+	p.Lock()
+	defer p.Unlock()
+	stats := p.current
+	p.current = ProbeStats{}
+	return &stats
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRotationBatch(t *testing.T) {
+	files := []string{"a", "b", "c", "d", "e"}
+
+	for _, size := range []int{0, 5, 6} {
+		if batch, next := rotationBatch(files, 3, size); !reflect.DeepEqual(batch, files) || next != 3 {
+			t.Errorf("size %d: expected every file, got %v (next %d)", size, batch, next)
+		}
+	}
+
+	next := 0
+	for _, expected := range [][]string{{"a", "b"}, {"c", "d"}, {"e", "a"}, {"b", "c"}} {
+		var batch []string
+		batch, next = rotationBatch(files, next, 2)
+		if !reflect.DeepEqual(batch, expected) {
+			t.Errorf("expected %v, got %v", expected, batch)
+		}
+	}
+}
+
+// fakeAdminSocket serves the HAProxy runtime API on a Unix socket,
+// recording each command and answering it with respond.
+type fakeAdminSocket struct {
+	sync.Mutex
+
+	commands []string
+	path     string
+}
+
+func newFakeAdminSocket(t *testing.T, respond func(command string) string) *fakeAdminSocket {
+	s := &fakeAdminSocket{path: path.Join(t.TempDir(), "haproxy.sock")}
+
+	listener, err := net.Listen("unix", s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			// A command with a payload ends at an empty line.
+			reader := bufio.NewReader(conn)
+			line, _ := reader.ReadString('\n')
+			command := strings.TrimSuffix(line, "\n")
+			if strings.HasSuffix(command, "<<") {
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil || line == "\n" {
+						break
+					}
+				}
+			}
+			s.Lock()
+			s.commands = append(s.commands, command)
+			s.Unlock()
+			_, _ = conn.Write([]byte(respond(command)))
+			_ = conn.Close()
+		}
+	}()
+
+	return s
+}
+
+func (s *fakeAdminSocket) Commands() []string {
+	s.Lock()
+	defer s.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+func TestSetSSLCert(t *testing.T) {
+	const file = "/certs/haproxy/domain.pem"
+
+	for _, tc := range []struct {
+		name     string
+		ocsp     []byte
+		respond  func(command string) string
+		commands []string
+		fails    bool
+	}{{
+		name: "commit",
+		respond: func(command string) string {
+			if strings.HasPrefix(command, "commit") {
+				return "Committing " + file + ".\nSuccess!\n"
+			}
+			return "Transaction created for certificate " + file + "!\n"
+		},
+		commands: []string{"set ssl cert " + file + " <<", "commit ssl cert " + file},
+	}, {
+		name: "commit with OCSP response",
+		ocsp: []byte("response"),
+		respond: func(command string) string {
+			switch {
+			case strings.HasPrefix(command, "commit"):
+				return "Committing " + file + ".\nSuccess!\n"
+			case strings.Contains(command, ".ocsp"):
+				return "Transaction updated for certificate " + file + "!\n"
+			}
+			return "Transaction created for certificate " + file + "!\n"
+		},
+		commands: []string{"set ssl cert " + file + " <<", "set ssl cert " + file + ".ocsp <<", "commit ssl cert " + file},
+	}, {
+		name: "abort when set fails",
+		respond: func(command string) string {
+			return "unable to load the certificate\n"
+		},
+		commands: []string{"set ssl cert " + file + " <<", "abort ssl cert " + file},
+		fails:    true,
+	}, {
+		name: "commit fails",
+		respond: func(command string) string {
+			if strings.HasPrefix(command, "commit") {
+				return "Committing " + file + ".\nerror: inconsistencies between private key and certificate\n"
+			}
+			return "Transaction created for certificate " + file + "!\n"
+		},
+		commands: []string{"set ssl cert " + file + " <<", "commit ssl cert " + file},
+		fails:    true,
+	}} {
+		socket := newFakeAdminSocket(t, tc.respond)
+
+		err := setSSLCert(socket.path, file, "PEM DATA\n", tc.ocsp)
+		if tc.fails && err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+		if !tc.fails && err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		}
+
+		if commands := socket.Commands(); !reflect.DeepEqual(commands, tc.commands) {
+			t.Errorf("%s: expected commands %q, got %q", tc.name, tc.commands, commands)
+		}
+	}
+}
+
+func TestRotateLeavesBackendCertificates(t *testing.T) {
+	outputDir := t.TempDir()
+
+	certBundle, err := CreateTLSCerts(KeyTypeECDSAP256, 0, time.Now(), time.Now().AddDate(1, 0, 0), "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backendCerts, err := writeCertificates(path.Join(outputDir, "certs"), certBundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	haproxyCertFile := certStore(haproxyCertDir(outputDir)).DomainFile
+	if err := createFile(haproxyCertFile, []byte(domainPEM(certBundle))); err != nil {
+		t.Fatal(err)
+	}
+
+	backendDomainPEM, err := os.ReadFile(backendCerts.DomainFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := haproxyCertificateFiles(haproxyCertDir(outputDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &RotateCertsCmd{Method: RotateReload, ReloadCommand: "true"}
+	if record := c.rotate(context.Background(), "", certBundle, files, nil); len(record.Errors) > 0 {
+		t.Fatalf("rotation failed: %v", record.Errors)
+	}
+
+	rotated, err := os.ReadFile(haproxyCertFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rotated) == domainPEM(certBundle) {
+		t.Error("expected the HAProxy certificate to be rotated")
+	}
+
+	if data, err := os.ReadFile(backendCerts.DomainFile); err != nil || string(data) != string(backendDomainPEM) {
+		t.Errorf("expected the backend certificate to be unchanged (%v)", err)
+	}
+
+	if _, err := tls.LoadX509KeyPair(backendCerts.DomainFile, backendCerts.TLSKeyFile); err != nil {
+		t.Errorf("backend certificate and key no longer match: %v", err)
+	}
+
+	// Reissuing the backend leaf keeps the HAProxy certificates.
+	if _, err := writeCertificates(path.Join(outputDir, "certs"), certBundle); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(haproxyCertFile); err != nil {
+		t.Errorf("HAProxy certificate removed with the backend certificates: %v", err)
+	}
+}
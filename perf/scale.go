@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// backendScaler adds and removes routes while serve-backends is
+// running. Its lock serialises changes to the set of running
+// backends, including churn.
+type backendScaler struct {
+	sync.Mutex
+
+	certs             *backendCerts
+	concurrency       int
+	handles           *backendHandles
+	host              string
+	hostPrefix        string
+	registry          *backendRegistry
+	serversPerBackend int
+	start             func(Backend) error
+	supervisor        *backendSupervisor
+	timeout           func(n int) time.Duration
+	trafficTypes      []TrafficType
+}
+
+// routes returns the route names of traffic type t served by this
+// host, in order.
+func (s *backendScaler) routes(t TrafficType) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, b := range s.registry.Backends()[t] {
+		if b.Host == s.host && !seen[b.Name] {
+			seen[b.Name] = true
+			names = append(names, b.Name)
+		}
+	}
+	return names
+}
+
+func (s *backendScaler) enabled(t TrafficType) bool {
+	for _, enabled := range s.trafficTypes {
+		if t == enabled {
+			return true
+		}
+	}
+	return false
+}
+
+// Scale adds or removes routes of traffic type t until there are n.
+// New routes are numbered after the existing ones and the
+// highest-numbered routes are removed first.
+func (s *backendScaler) Scale(ctx context.Context, t TrafficType, n int) error {
+	s.Lock()
+	defer s.Unlock()
+
+	routes := s.routes(t)
+
+	switch {
+	case n > len(routes):
+		return s.add(ctx, t, len(routes), n)
+	case n < len(routes):
+		return s.remove(t, routes[n:])
+	}
+
+	return nil
+}
+
+func (s *backendScaler) add(ctx context.Context, t TrafficType, from, to int) error {
+	var names []string
+	var backends []Backend
+
+	for i := from; i < to; i++ {
+		name := fmt.Sprintf("%s-%v-%v", s.hostPrefix, t, i)
+		names = append(names, name)
+		for server := 0; server < s.serversPerBackend; server++ {
+			backends = append(backends, Backend{
+				Host:        s.host,
+				Name:        name,
+				Server:      server,
+				TrafficType: t,
+			})
+		}
+	}
+
+	if err := s.certs.Cover(names...); err != nil {
+		return err
+	}
+
+	log.Printf("scale: adding %d %s backend(s)\n", to-from, t)
+
+	return s.Launch(ctx, backends)
+}
+
+// Launch starts backends, no more than s.concurrency at a time, and
+// waits for them to register. Progress is logged every second and,
+// should they not all register in time, those that did not are
+// stopped and named in the error.
+func (s *backendScaler) Launch(ctx context.Context, backends []Backend) error {
+	s.registry.Expect(backends...)
+
+	timeout := s.timeout(len(backends))
+	launchCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	unregistered := func() []Backend {
+		var missing []Backend
+		for _, b := range backends {
+			if _, ok := s.registry.Lookup(b.ID()); !ok {
+				missing = append(missing, b)
+			}
+		}
+		return missing
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-launchCtx.Done():
+				return
+			case <-ticker.C:
+				log.Printf("%d/%d backend server(s) registered\n", len(backends)-len(unregistered()), len(backends))
+			}
+		}
+	}()
+
+	g := errgroup.Group{}
+	g.SetLimit(s.concurrency)
+
+	for _, b := range backends {
+		b := b
+		g.Go(func() error {
+			if launchCtx.Err() != nil {
+				return nil
+			}
+			if err := s.start(b); err != nil {
+				return err
+			}
+			return s.awaitRegistration(launchCtx, b.ID())
+		})
+	}
+
+	if err := g.Wait(); err != nil && launchCtx.Err() == nil {
+		return err
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if missing := unregistered(); len(missing) > 0 {
+		const maxListed = 20
+		var ids []string
+		for i, b := range missing {
+			if i == maxListed {
+				ids = append(ids, fmt.Sprintf("and %d more", len(missing)-maxListed))
+				break
+			}
+			ids = append(ids, b.ID())
+		}
+		if err := s.stop(missing); err != nil {
+			return err
+		}
+		return fmt.Errorf("timeout after %v waiting for %d of %d backend server(s) to register: %s", timeout, len(missing), len(backends), strings.Join(ids, ", "))
+	}
+
+	return nil
+}
+
+// awaitRegistration waits until the backend with id is live.
+func (s *backendScaler) awaitRegistration(ctx context.Context, id string) error {
+	for {
+		changed := s.registry.Changed()
+		if _, ok := s.registry.Lookup(id); ok {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *backendScaler) remove(t TrafficType, names []string) error {
+	removed := map[string]bool{}
+	for _, name := range names {
+		removed[name] = true
+	}
+
+	var backends []Backend
+	for _, b := range s.registry.Backends()[t] {
+		if removed[b.Name] {
+			backends = append(backends, b)
+		}
+	}
+
+	log.Printf("scale: removing %d %s backend(s)\n", len(names), t)
+
+	return s.stop(backends)
+}
+
+// stop removes backends and stops them.
+func (s *backendScaler) stop(backends []Backend) error {
+	// Forget the backends first so that clients stop seeing them
+	// before they go away.
+	s.registry.Remove(backends...)
+
+	g := errgroup.Group{}
+	g.SetLimit(64)
+	for _, b := range backends {
+		b := b
+		g.Go(func() error {
+			if h, ok := s.handles.Get(b.ID()); ok {
+				h.Stop()
+				s.handles.Delete(b.ID())
+			}
+			s.supervisor.Forget(b.ID())
+			return nil
+		})
+	}
+
+	return g.Wait()
+}
+
+// Restart starts the backend of h again after it died, unless it has
+// since been removed or replaced.
+func (s *backendScaler) Restart(h *backendHandle) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if current, ok := s.handles.Get(h.backend.ID()); !ok || current != h {
+		return nil
+	}
+
+	if err := s.start(h.backend); err != nil {
+		return err
+	}
+
+	// start skips backends removed in the meantime; only a new
+	// handle means that the backend is running again.
+	if current, ok := s.handles.Get(h.backend.ID()); ok && current != h {
+		s.supervisor.Restarted(h.backend.ID())
+	}
+
+	return nil
+}
+
+// ServeHTTP reports the number of routes per traffic type (GET) or
+// scales the routes of the "traffic-type" query parameter to the
+// "backends" query parameter (PUT, POST).
+func (s *backendScaler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		t, err := parseTrafficType(r.URL.Query().Get("traffic-type"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !s.enabled(t) {
+			http.Error(w, fmt.Sprintf("traffic type %q is not enabled", t), http.StatusBadRequest)
+			return
+		}
+		n, err := strconv.Atoi(r.URL.Query().Get("backends"))
+		if err != nil || n < 0 {
+			http.Error(w, "backends must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		// Launching many backends can take longer than the
+		// server's WriteTimeout.
+		clearWriteDeadline(r)
+		if err := s.Scale(r.Context(), t, n); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, r.Method, http.StatusMethodNotAllowed)
+		return
+	}
+
+	routes := map[TrafficType]int{}
+	for _, t := range s.trafficTypes {
+		routes[t] = len(s.routes(t))
+	}
+
+	if _, ok := r.URL.Query()["json"]; !ok {
+		for _, t := range s.trafficTypes {
+			if _, err := io.WriteString(w, fmt.Sprintf("%v %v\n", t, routes[t])); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		return
+	}
+
+	data, err := json.MarshalIndent(routes, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := io.WriteString(w, string(data)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Snapshot records the topology of a serve-backends run: where every
+// live backend listens and the certificates they use. gen-proxy-config
+// and gen-workload can read it instead of querying the metadata
+// server, which allows regenerating configuration after the run or on
+// another machine.
+type Snapshot struct {
+	Backends     BoundBackendsByTrafficType `json:"backends"`
+	Certificates *Certificates              `json:"certificates"`
+	CreatedAt    time.Time                  `json:"created_at"`
+	Version      uint64                     `json:"version"`
+}
+
+func readSnapshot(filename string) (*Snapshot, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot %s: %v", filename, err)
+	}
+
+	if snapshot.Certificates == nil {
+		return nil, fmt.Errorf("snapshot %s has no certificates", filename)
+	}
+
+	return &snapshot, nil
+}
+
+// writeSnapshot replaces filename atomically so that readers never
+// see a partial snapshot.
+func writeSnapshot(filename string, snapshot *Snapshot) error {
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpFile := filename + ".tmp"
+	if err := createFile(tmpFile, data); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile, filename)
+}
+
+// snapshotWriter rewrites filename with the result of snapshot
+// whenever changed fires, at most once per second, until ctx is done.
+func snapshotWriter(ctx context.Context, filename string, changed func() <-chan struct{}, snapshot func() *Snapshot) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+
+	for {
+		next := changed()
+		if err := writeSnapshot(filename, snapshot()); err != nil {
+			log.Printf("failed to write snapshot %s: %v\n", filename, err)
+		}
+		select {
+		case <-next:
+		case <-ctx.Done():
+			return nil
+		}
+		if !sleepContext(ctx, time.Second) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// BackendStats are the counters a backend keeps for the test traffic
+// it serves. Requests to the control endpoints are not counted.
+type BackendStats struct {
+	Requests uint64 `json:"requests"`
+	Errors   uint64 `json:"errors"`
+	BytesIn  uint64 `json:"bytes_in"`
+	BytesOut uint64 `json:"bytes_out"`
+}
+
+// BoundBackendStats pairs a backend with the counters collected from
+// it. Error is set if the backend could not be queried.
+type BoundBackendStats struct {
+	BoundBackend
+
+	Stats BackendStats `json:"stats"`
+	Error string       `json:"error,omitempty"`
+}
+
+type BoundBackendStatsByTrafficType map[TrafficType][]BoundBackendStats
+
+type statsCollector struct {
+	requests atomic.Uint64
+	errors   atomic.Uint64
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+}
+
+func (c *statsCollector) Get() BackendStats {
+	return BackendStats{
+		Requests: c.requests.Load(),
+		Errors:   c.errors.Load(),
+		BytesIn:  c.bytesIn.Load(),
+		BytesOut: c.bytesOut.Load(),
+	}
+}
+
+func (c *statsCollector) Reset() {
+	c.requests.Store(0)
+	c.errors.Store(0)
+	c.bytesIn.Store(0)
+	c.bytesOut.Store(0)
+}
+
+// countingReader counts the request body bytes read by the handler.
+type countingReader struct {
+	io.ReadCloser
+
+	count *atomic.Uint64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.count.Add(uint64(n))
+	return n, err
+}
+
+// countingWriter counts response body bytes and remembers the
+// status. It passes Flush and Hijack through so that the delay and
+// fault handlers underneath keep working.
+type countingWriter struct {
+	http.ResponseWriter
+
+	count  *atomic.Uint64
+	status int
+}
+
+func (w *countingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(data)
+	w.count.Add(uint64(n))
+	return n, err
+}
+
+func (w *countingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *countingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T is not a http.Hijacker", w.ResponseWriter)
+	}
+	return hj.Hijack()
+}
+
+// Handler counts every request passed to next. Responses with a 5xx
+// status and aborted handlers are errors.
+func (c *statsCollector) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.requests.Add(1)
+
+		if r.Body != nil {
+			r.Body = &countingReader{ReadCloser: r.Body, count: &c.bytesIn}
+		}
+
+		cw := &countingWriter{ResponseWriter: w, count: &c.bytesOut}
+
+		completed := false
+		defer func() {
+			if !completed || cw.status >= 500 {
+				c.errors.Add(1)
+			}
+		}()
+
+		next.ServeHTTP(cw, r)
+		completed = true
+	})
+}
+
+// ServeHTTP implements the backend's /_hydra/stats control endpoint:
+// GET returns the counters, DELETE returns and then resets them.
+func (c *statsCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	stats := c.Get()
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		c.Reset()
+	default:
+		http.Error(w, r.Method, http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := json.Marshal(stats)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
+
+// collectBackendStats queries the stats control endpoint of every
+// backend in backendsByTrafficType, preserving its order.
+func collectBackendStats(client *http.Client, method string, backendsByTrafficType BoundBackendsByTrafficType) BoundBackendStatsByTrafficType {
+	var all []BoundBackend
+	for _, t := range knownTrafficTypes() {
+		all = append(all, backendsByTrafficType[t]...)
+	}
+
+	results := broadcastControlRequest(client, all, method, "stats", nil)
+
+	statsByTrafficType := BoundBackendStatsByTrafficType{}
+	for _, t := range knownTrafficTypes() {
+		for _, b := range backendsByTrafficType[t] {
+			entry := BoundBackendStats{BoundBackend: b}
+			result := results[b.ID()]
+			if result.Error != "" {
+				entry.Error = result.Error
+			} else if err := json.Unmarshal(result.Response, &entry.Stats); err != nil {
+				entry.Error = err.Error()
+			}
+			statsByTrafficType[t] = append(statsByTrafficType[t], entry)
+		}
+	}
+
+	return statsByTrafficType
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+type RestartPolicy string
+
+const (
+	RestartAlways    RestartPolicy = "always"
+	RestartNever     RestartPolicy = "never"
+	RestartOnFailure RestartPolicy = "on-failure"
+)
+
+// BackendStatus is the supervision history of a backend server.
+type BackendStatus struct {
+	PID      int    `json:"pid,omitempty"`
+	Deaths   int    `json:"deaths"`
+	Restarts int    `json:"restarts"`
+	LastExit string `json:"last_exit,omitempty"`
+}
+
+func (s BackendStatus) String() string {
+	result := fmt.Sprintf("pid=%v deaths=%v restarts=%v", s.PID, s.Deaths, s.Restarts)
+	if s.LastExit != "" {
+		result += fmt.Sprintf(" last_exit=%q", s.LastExit)
+	}
+	return result
+}
+
+// backendSupervisor records when backends start and die and decides,
+// according to its restart policy, whether a dead backend is
+// restarted.
+type backendSupervisor struct {
+	sync.Mutex
+
+	policy RestartPolicy
+	status map[string]*BackendStatus
+}
+
+func newBackendSupervisor(policy RestartPolicy) *backendSupervisor {
+	return &backendSupervisor{
+		policy: policy,
+		status: map[string]*BackendStatus{},
+	}
+}
+
+func (s *backendSupervisor) lookup(id string) *BackendStatus {
+	status, ok := s.status[id]
+	if !ok {
+		status = &BackendStatus{}
+		s.status[id] = status
+	}
+	return status
+}
+
+// Started records the process ID of a newly started backend; it is
+// zero for in-process backends.
+func (s *backendSupervisor) Started(h *backendHandle) {
+	s.Lock()
+	defer s.Unlock()
+	s.lookup(h.backend.ID()).PID = h.pid
+}
+
+// Restarted counts a successful restart of the backend with id.
+func (s *backendSupervisor) Restarted(id string) {
+	s.Lock()
+	defer s.Unlock()
+	s.lookup(id).Restarts++
+}
+
+// Died records the unexpected exit of h and reports whether it should
+// be restarted. The restart is only counted once it has succeeded.
+func (s *backendSupervisor) Died(h *backendHandle) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	status := s.lookup(h.backend.ID())
+	status.Deaths++
+	status.LastExit = h.exit
+
+	restart := s.policy == RestartAlways || (s.policy == RestartOnFailure && h.failed)
+
+	log.Printf("backend %s (pid %d) died: %s; restart=%v deaths=%d\n", h.backend.ID(), h.pid, h.exit, restart, status.Deaths)
+	return restart
+}
+
+func (s *backendSupervisor) Status(id string) (BackendStatus, bool) {
+	s.Lock()
+	defer s.Unlock()
+	status, ok := s.status[id]
+	if !ok {
+		return BackendStatus{}, false
+	}
+	return *status, true
+}
+
+// Forget drops the history of a backend that has been removed.
+func (s *backendSupervisor) Forget(id string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.status, id)
+}
@@ -1,14 +1,18 @@
 package main
 
+import "fmt"
+
 type TrafficType string
 
 const (
 	EdgeTraffic        TrafficType = "edge"
+	GRPCTraffic        TrafficType = "grpc"
 	HTTPTraffic        TrafficType = "http"
 	PassthroughTraffic TrafficType = "passthrough"
 	ReencryptTraffic   TrafficType = "reencrypt"
 )
 
+// AllTrafficTypes lists the traffic types served by default.
 var AllTrafficTypes = [...]TrafficType{
 	EdgeTraffic,
 	HTTPTraffic,
@@ -16,16 +20,53 @@ var AllTrafficTypes = [...]TrafficType{
 	ReencryptTraffic,
 }
 
+// OptionalTrafficTypes are only served when enabled, so that they do
+// not change the default topology. gRPC traffic (--grpc) is cleartext
+// h2c end to end: clients use prior knowledge on the HAProxy HTTP port
+// and HAProxy speaks h2 to the backends.
+var OptionalTrafficTypes = [...]TrafficType{
+	GRPCTraffic,
+}
+
+// knownTrafficTypes returns every traffic type a backend may have,
+// enabled or not.
+func knownTrafficTypes() []TrafficType {
+	return append(AllTrafficTypes[:], OptionalTrafficTypes[:]...)
+}
+
+// TrafficTypes returns the traffic types enabled by the flags.
+func (g Globals) TrafficTypes() []TrafficType {
+	types := AllTrafficTypes[:]
+	if g.GRPC {
+		types = append(types, GRPCTraffic)
+	}
+	return types
+}
+
+func parseTrafficType(s string) (TrafficType, error) {
+	for _, t := range knownTrafficTypes() {
+		if string(t) == s {
+			return t, nil
+		}
+	}
+	return "", fmt.Errorf("unknown traffic type %q", s)
+}
+
 func mustParseTrafficType(s string) TrafficType {
-	switch s {
-	case "http":
-		return HTTPTraffic
-	case "edge":
-		return EdgeTraffic
-	case "reencrypt":
-		return ReencryptTraffic
-	case "passthrough":
-		return PassthroughTraffic
+	t, err := parseTrafficType(s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// BackendTLS reports whether backends of this traffic type terminate
+// TLS themselves.
+func (t TrafficType) BackendTLS() bool {
+	switch t {
+	case HTTPTraffic, EdgeTraffic, GRPCTraffic:
+		return false
+	default:
+		return true
 	}
-	panic("unknown taffic type" + s)
 }
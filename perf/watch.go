@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BackendWatchResult is the long-poll response of /watch.
+type BackendWatchResult struct {
+	Events          []BackendEvent `json:"events"`
+	ResourceVersion uint64         `json:"resource_version"`
+}
+
+type connContextKey struct{}
+
+// withConn is the metadata server's ConnContext: it makes the
+// connection of each request available to handlers that need to lift
+// the server's WriteTimeout.
+func withConn(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, c)
+}
+
+// clearWriteDeadline lifts the server's WriteTimeout for the rest of
+// r. The server sets the deadline again for the next request on the
+// connection.
+func clearWriteDeadline(r *http.Request) {
+	if c, ok := r.Context().Value(connContextKey{}).(net.Conn); ok {
+		_ = c.SetWriteDeadline(time.Time{})
+	}
+}
+
+// watchHandler follows changes to the live backends, much as the
+// OpenShift router follows endpoints from the API server.
+//
+// Without a resource version the current backends are sent first as
+// "added" events. With ?resource-version=N (or a Last-Event-ID
+// header) only the events after N are sent; 410 Gone means N is too
+// old and the client must start again without one.
+//
+// With "Accept: text/event-stream" or ?stream the events are
+// streamed as server-sent events until ctx is done or the client
+// goes away. Otherwise the request long-polls: it returns as soon as
+// there are events, or empty after ?timeout (default 30s).
+func watchHandler(ctx context.Context, registry *backendRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, r.Method, http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Long polls and streams outlast the WriteTimeout.
+		clearWriteDeadline(r)
+
+		query := r.URL.Query()
+
+		resourceVersion := query.Get("resource-version")
+		if resourceVersion == "" {
+			resourceVersion = r.Header.Get("Last-Event-ID")
+		}
+
+		var (
+			events []BackendEvent
+			since  uint64
+		)
+
+		if resourceVersion == "" {
+			events, since = registry.List()
+		} else {
+			var err error
+			if since, err = strconv.ParseUint(resourceVersion, 10, 64); err != nil {
+				http.Error(w, "invalid resource version", http.StatusBadRequest)
+				return
+			}
+		}
+
+		_, stream := query["stream"]
+		stream = stream || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+
+		if !stream {
+			timeout := 30 * time.Second
+			if v := query.Get("timeout"); v != "" {
+				d, err := time.ParseDuration(v)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				timeout = d
+			}
+			longPoll(ctx, w, r, registry, events, since, timeout)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+
+		for {
+			changed := registry.Changed()
+
+			for _, e := range events {
+				data, err := json.Marshal(e)
+				if err != nil {
+					return
+				}
+				if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Version, e.Type, data); err != nil {
+					return
+				}
+				since = e.Version
+			}
+			flusher.Flush()
+
+			select {
+			case <-changed:
+			case <-r.Context().Done():
+				return
+			case <-ctx.Done():
+				return
+			}
+
+			if events, ok = registry.EventsSince(since); !ok {
+				// The stream fell too far behind; the client
+				// reconnects without a resource version.
+				return
+			}
+		}
+	}
+}
+
+func longPoll(ctx context.Context, w http.ResponseWriter, r *http.Request, registry *backendRegistry, events []BackendEvent, since uint64, timeout time.Duration) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for len(events) == 0 {
+		changed := registry.Changed()
+
+		var ok bool
+		if events, ok = registry.EventsSince(since); !ok {
+			http.Error(w, "resource version too old", http.StatusGone)
+			return
+		}
+
+		if len(events) > 0 {
+			break
+		}
+
+		select {
+		case <-changed:
+			continue
+		case <-deadline.C:
+		case <-r.Context().Done():
+		case <-ctx.Done():
+		}
+		break
+	}
+
+	result := BackendWatchResult{
+		Events:          events,
+		ResourceVersion: since,
+	}
+
+	if len(events) > 0 {
+		result.ResourceVersion = events[len(events)-1].Version
+	}
+
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := io.WriteString(w, string(data)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// websocketPath is where backends serve the WebSocket echo handler.
+const websocketPath = "/ws"
+
+// websocketEchoHandler echoes every message back to the client. Any
+// origin is accepted.
+func websocketEchoHandler() websocket.Server {
+	return websocket.Server{
+		Handshake: func(*websocket.Config, *http.Request) error {
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			// The server's read and write timeouts survive the
+			// hijack; long-lived connections must not inherit
+			// them.
+			_ = ws.SetDeadline(time.Time{})
+			for {
+				var msg []byte
+				if err := websocket.Message.Receive(ws, &msg); err != nil {
+					return
+				}
+				if err := websocket.Message.Send(ws, msg); err != nil {
+					return
+				}
+			}
+		},
+	}
+}
+
+// websocketRTTSamples bounds the round-trip times kept for the
+// percentiles: beyond it, a uniform random sample of every message is
+// kept (reservoir sampling) so that memory does not grow with the
+// length of the test.
+const websocketRTTSamples = 10000
+
+type websocketResults struct {
+	active   atomic.Int64
+	connects atomic.Uint64
+	dialErrs atomic.Uint64
+	drops    atomic.Uint64
+	messages atomic.Uint64
+	rttsLock sync.Mutex
+	rtts     []time.Duration
+	rttCount int64
+	rttTotal time.Duration
+	rttMin   time.Duration
+	rttMax   time.Duration
+}
+
+func (r *websocketResults) recordRTT(rtt time.Duration) {
+	r.messages.Add(1)
+	r.rttsLock.Lock()
+	defer r.rttsLock.Unlock()
+	r.rttCount++
+	r.rttTotal += rtt
+	if r.rttCount == 1 || rtt < r.rttMin {
+		r.rttMin = rtt
+	}
+	if rtt > r.rttMax {
+		r.rttMax = rtt
+	}
+	if len(r.rtts) < websocketRTTSamples {
+		r.rtts = append(r.rtts, rtt)
+	} else if i := rand.Int63n(r.rttCount); i < websocketRTTSamples {
+		r.rtts[i] = rtt
+	}
+}
+
+func (r *websocketResults) progress() string {
+	return fmt.Sprintf("active: %v connects: %v drops: %v dial-errors: %v messages: %v",
+		r.active.Load(), r.connects.Load(), r.drops.Load(), r.dialErrs.Load(), r.messages.Load())
+}
+
+// summary is progress plus the round-trip latency distribution of the
+// messages echoed during the test. The minimum, average and maximum
+// are exact; the percentiles are estimated from the sample.
+func (r *websocketResults) summary() string {
+	r.rttsLock.Lock()
+	rtts := make([]time.Duration, len(r.rtts))
+	copy(rtts, r.rtts)
+	count, total, minRTT, maxRTT := r.rttCount, r.rttTotal, r.rttMin, r.rttMax
+	r.rttsLock.Unlock()
+
+	s := r.progress()
+
+	if count == 0 {
+		return s
+	}
+
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+
+	percentile := func(p float64) time.Duration {
+		return rtts[int(p*float64(len(rtts)-1))]
+	}
+
+	return fmt.Sprintf("%s rtt min/avg/p50/p99/max: %v/%v/%v/%v/%v", s,
+		minRTT, total/time.Duration(count), percentile(0.5), percentile(0.99), maxRTT)
+}
+
+// websocketClient keeps one WebSocket connection to url open until
+// ctx is done, sending a message every interval and timing the echo.
+// Dropped connections, for example across an HAProxy reload, are
+// counted and re-established.
+func (c *TestCmd) websocketClient(ctx context.Context, url string, tlsConfig *tls.Config, results *websocketResults) {
+	config, err := websocket.NewConfig(url, "http://localhost/")
+	if err != nil {
+		log.Printf("%s: %v", url, err)
+		return
+	}
+	config.TlsConfig = tlsConfig
+	config.Dialer = &net.Dialer{Timeout: 5 * time.Second}
+
+	payload := make([]byte, c.WebSocketMessageSize)
+
+	for ctx.Err() == nil {
+		ws, err := config.DialContext(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				results.dialErrs.Add(1)
+				log.Printf("%s: %v", url, err)
+				sleepContext(ctx, time.Second)
+			}
+			continue
+		}
+
+		results.connects.Add(1)
+		results.active.Add(1)
+		err = c.websocketExchange(ctx, ws, payload, results)
+		results.active.Add(-1)
+		_ = ws.Close()
+
+		if ctx.Err() == nil {
+			results.drops.Add(1)
+			log.Printf("%s: connection dropped: %v", url, err)
+		}
+	}
+}
+
+func (c *TestCmd) websocketExchange(ctx context.Context, ws *websocket.Conn, payload []byte, results *websocketResults) error {
+	ticker := time.NewTicker(c.WebSocketInterval)
+	defer ticker.Stop()
+
+	// Unblock Receive when the test ends.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = ws.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	for {
+		binary.BigEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+		if err := websocket.Message.Send(ws, payload); err != nil {
+			return err
+		}
+
+		var echo []byte
+		if err := websocket.Message.Receive(ws, &echo); err != nil {
+			return err
+		}
+		if len(echo) < 8 {
+			return errors.New("short echo")
+		}
+		sent := time.Unix(0, int64(binary.BigEndian.Uint64(echo)))
+		results.recordRTT(time.Since(sent))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *TestCmd) runWebSocket(p *ProgramCtx, requests []MBRequest, tlsConfig *tls.Config) error {
+	if c.WebSocketMessageSize < 8 {
+		return fmt.Errorf("--websocket-message-size must be at least 8")
+	}
+	if c.WebSocketInterval <= 0 {
+		return fmt.Errorf("--websocket-interval must be positive")
+	}
+
+	ctx, cancel := context.WithTimeout(p.Context, c.Duration)
+	defer cancel()
+
+	var (
+		results websocketResults
+		wg      sync.WaitGroup
+	)
+
+	for _, request := range requests {
+		scheme := "ws"
+		if request.Scheme == "https" {
+			scheme = "wss"
+		}
+		url := fmt.Sprintf("%v://%v:%v%v", scheme, request.Host, testPort(p, request.Scheme), websocketPath)
+		for i := 0; i < c.WebSocketConnections; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c.websocketClient(ctx, url, tlsConfig, &results)
+			}()
+		}
+	}
+
+	progressTicker := time.NewTicker(1 * time.Second)
+	defer progressTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			log.Println(results.summary())
+			if p.Context.Err() != nil {
+				return errors.New("test interrupted")
+			}
+			return nil
+		case <-progressTicker.C:
+			log.Println(results.progress())
+		}
+	}
+}